@@ -0,0 +1,263 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/config"
+)
+
+// loadConfig loads the configuration file, if one was specified, and applies
+// the environment and any flags that were set on top of it.
+func loadConfig(fs *flag.FlagSet) (*config.Config, error) {
+	cfg := config.Default()
+	if path := fs.Lookup("config").Value.String(); path != "" {
+		var err error
+		cfg, err = config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// account returns the only configured account, creating it if none are
+	// configured.
+	account := func(name string) (*config.Account, error) {
+		switch len(cfg.Accounts) {
+		case 0:
+			cfg.Accounts = append(cfg.Accounts, &config.Account{})
+			fallthrough
+		case 1:
+			return cfg.Accounts[0], nil
+		}
+		return nil, errors.Errorf("-%s cannot be used when multiple accounts are configured", name)
+	}
+
+	// credentials is the account whose credentials were set by a flag or the
+	// environment, if any.
+	var credentials *config.Account
+
+	// Fallback to the environment for credentials that were not set by a flag.
+	set := map[string]struct{}{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = struct{}{}
+	})
+	if len(cfg.Accounts) <= 1 {
+		for _, name := range []string{"token", "token-file", "email", "key", "key-file"} {
+			if _, ok := set[name]; ok {
+				continue
+			}
+			env := "CF_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+			if v := os.Getenv(env); v != "" {
+				a, _ := account(name)
+				setCredential(a, name, v)
+				credentials = a
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		v := f.Value.(flag.Getter).Get()
+
+		switch f.Name {
+		case "bind":
+			cfg.Listen = v.(string)
+		case "mode":
+			cfg.Mode = v.(string)
+		case "scrape-cache":
+			cfg.ScrapeCache = v.(time.Duration)
+		case "interval":
+			cfg.Interval = v.(time.Duration)
+		case "lag":
+			cfg.Lag = v.(time.Duration)
+		case "collect-timeout":
+			cfg.CollectTimeout = v.(time.Duration)
+		case "batch-size":
+			cfg.BatchSize = v.(int)
+		case "concurrency":
+			cfg.Concurrency = v.(int)
+		case "limit":
+			cfg.Limit = v.(int)
+		case "api-url":
+			cfg.APIURL = v.(string)
+		case "timeout":
+			cfg.Timeout = v.(time.Duration)
+		case "retries":
+			cfg.Retries = v.(int)
+		case "rate-limit":
+			cfg.RateLimit = v.(float64)
+		case "rate-burst":
+			cfg.RateBurst = v.(int)
+		case "record":
+			cfg.Record = v.(string)
+		case "replay":
+			cfg.Replay = v.(string)
+		case "max-lookback":
+			cfg.Lookback = v.(time.Duration)
+		case "series-ttl":
+			cfg.SeriesTTL = v.(time.Duration)
+		case "state-file":
+			cfg.StateFile = v.(string)
+		case "state-interval":
+			cfg.StateInterval = v.(time.Duration)
+
+		case "token", "token-file", "email", "key", "key-file":
+			var a *config.Account
+			if a, err = account(f.Name); err == nil {
+				setCredential(a, f.Name, v.(string))
+				credentials = a
+			}
+		case "zones":
+			var a *config.Account
+			if a, err = account(f.Name); err == nil {
+				err = setZones(a, v.(string))
+			}
+		case "discover":
+			var a *config.Account
+			if a, err = account(f.Name); err == nil {
+				if !v.(bool) {
+					a.Discover = nil
+				} else if a.Discover == nil {
+					a.Discover = &config.Discover{}
+				}
+			}
+		case "discover-include", "discover-exclude", "discover-accounts", "discover-plans",
+			"discover-interval":
+			var a *config.Account
+			if a, err = account(f.Name); err == nil {
+				if a.Discover == nil {
+					a.Discover = &config.Discover{}
+				}
+				setDiscover(a.Discover, f.Name, v)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credentials != nil {
+		dropIncompleteKey(credentials)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// setCredential sets a credential on the account. Credentials of the other
+// authentication method are only cleared once the credentials of this method
+// are complete, so a token is kept while only an email or key is set.
+func setCredential(a *config.Account, name, v string) {
+	switch name {
+	case "token":
+		a.Token, a.TokenFrom = v, nil
+	case "token-file":
+		a.Token, a.TokenFrom = "", &config.Secret{File: v}
+	case "email":
+		a.Email = v
+	case "key":
+		a.Key, a.KeyFrom = v, nil
+	case "key-file":
+		a.Key, a.KeyFrom = "", &config.Secret{File: v}
+	}
+
+	switch name {
+	case "token", "token-file":
+		a.Email, a.Key, a.KeyFrom = "", "", nil
+	default:
+		if a.Email != "" && a.HasKey() {
+			a.Token, a.TokenFrom = "", nil
+		}
+	}
+}
+
+// dropIncompleteKey removes an email or key that is missing the other while the
+// account has a token, in which case the token is used.
+func dropIncompleteKey(a *config.Account) {
+	if a.HasToken() && (a.Email == "" || !a.HasKey()) {
+		a.Email, a.Key, a.KeyFrom = "", "", nil
+	}
+}
+
+// setZones adds the zones from a comma separated list of zone_id:domain pairs
+// to the account, replacing any zones with the same ID.
+func setZones(a *config.Account, v string) error {
+	if v == "" {
+		return nil
+	}
+	for _, z := range strings.Split(v, ",") {
+		s := strings.SplitN(z, ":", 2)
+		if len(s) != 2 {
+			return errors.Errorf("invalid zone \"%s\": missing `:` (zone_id:domain)", z)
+		}
+
+		zone := &config.Zone{ID: s[0], Name: s[1]}
+		replaced := false
+		for i, existing := range a.Zones {
+			if existing.ID == zone.ID {
+				a.Zones[i], replaced = zone, true
+			}
+		}
+		if !replaced {
+			a.Zones = append(a.Zones, zone)
+		}
+	}
+	return nil
+}
+
+// setDiscover sets a discovery option from its flag.
+func setDiscover(d *config.Discover, name string, v interface{}) {
+	switch name {
+	case "discover-include":
+		d.Include = splitList(v.(string))
+	case "discover-exclude":
+		d.Exclude = splitList(v.(string))
+	case "discover-accounts":
+		d.Accounts = splitList(v.(string))
+	case "discover-plans":
+		d.Plans = splitList(v.(string))
+	case "discover-interval":
+		d.Interval = v.(time.Duration)
+	}
+}
+
+// splitList splits a comma separated list, ignoring empty entries.
+func splitList(v string) []string {
+	var l []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			l = append(l, s)
+		}
+	}
+	return l
+}
@@ -23,6 +23,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
@@ -30,126 +31,152 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/collector"
 	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+	"github.com/matthewpi/cloudflare-exporter/internal/state"
 )
 
-var cf *cloudflare.Cloudflare
-
-var zones []string
-var zoneIDMap = map[string]string{}
+var col *collector.Collector
 
 func main() {
+	// The preflight command only checks what would be collected.
+	args, command := os.Args[1:], ""
+	if len(args) > 0 && args[0] == "preflight" {
+		args, command = args[1:], args[0]
+	}
+
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.String("config", "", "path to the configuration file")
+	runPreflight := fs.Bool(
+		"preflight",
+		true,
+		"check which datasets can be read at startup and exit if the credentials cannot read any",
+	)
+	watch := fs.Duration("watch-config", 0, "how often to check the configuration file for changes")
+	enableReload := fs.Bool(
+		"enable-reload",
+		false,
+		"enable reloading the configuration via POST /-/reload",
+	)
 	fs.String("bind", ":8089", "")
 	fs.String("token", "", "")
+	fs.String("token-file", "", "path to a file containing the API token")
 	fs.String("email", "", "")
 	fs.String("key", "", "")
+	fs.String("key-file", "", "path to a file containing the Global API Key")
 	fs.String("zones", "", "comma separated list of zone_id:domain")
-	if err := fs.Parse(os.Args[1:]); err != nil {
+	fs.Bool("discover", false, "discover zones visible to the configured credentials")
+	fs.String("discover-include", "", "comma separated list of zone name globs to include")
+	fs.String("discover-exclude", "", "comma separated list of zone name globs to exclude")
+	fs.String("discover-accounts", "", "comma separated list of account ids to include")
+	fs.String("discover-plans", "", "comma separated list of plans to include")
+	fs.Duration("discover-interval", 10*time.Minute, "how often to refresh discovered zones")
+	fs.String("mode", "background", "collect metrics in the background or when scraped (scrape)")
+	fs.Duration("scrape-cache", 30*time.Second, "how long to reuse the result of a scrape")
+	fs.Duration("interval", time.Minute, "how often to collect metrics")
+	fs.Duration("lag", 3*time.Minute, "how far behind the current time metrics are collected")
+	fs.Duration("collect-timeout", 5*time.Minute, "maximum duration of a single collection")
+	fs.Int("batch-size", 10, "maximum number of zones sent in a single query")
+	fs.Int("concurrency", 4, "maximum number of queries running at once")
+	fs.Int("limit", 1000, "maximum number of rows requested per zone and dataset")
+	fs.String("api-url", cloudflare.DefaultURL, "base URL of the Cloudflare API")
+	fs.Duration("timeout", 30*time.Second, "timeout of a single request to Cloudflare")
+	fs.Int("retries", 3, "maximum number of retries of a failed request")
+	fs.Float64("rate-limit", 4, "maximum number of requests per second for each account")
+	fs.Int("rate-burst", 10, "maximum number of requests sent at once for each account")
+	fs.String("record", "", "directory to record every Cloudflare API response to")
+	fs.String("replay", "", "directory of recorded responses to serve instead of the Cloudflare API")
+	fs.Duration("max-lookback", time.Hour, "maximum age of missed minutes to backfill")
+	fs.Duration("series-ttl", 0, "how long series that are no longer updated are exported for, 0 keeps them forever")
+	fs.String("state-file", "", "path to persist counters across restarts")
+	fs.Duration("state-interval", time.Minute, "how often to write the state file")
+	if err := fs.Parse(args); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 		return
 	}
-	fs.VisitAll(func(f *flag.Flag) {
-		if f.Value != nil && f.Value.String() != "" {
-			return
-		}
-		if f.Name == "zones" {
-			fmt.Println("Zones: " + f.Value.String())
-			return
-		}
 
-		if f.Name != "token" && f.Name != "email" && f.Name != "key" {
-			return
-		}
+	cfg, err := loadConfig(fs)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+		return
+	}
 
-		if err := f.Value.Set(os.Getenv("CF_" + strings.ToUpper(f.Name))); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-			return
-		}
-	})
+	col = collector.New(cfg.Lag, cfg.Lookback)
+
+	// Create a context that is cancelled by an interrupt or termination
+	// signal, as sent by docker stop and Kubernetes.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-	zonesFlag := fs.Lookup("zones").Value.String()
-	if zonesFlag == "" {
-		fmt.Println("no zones specified")
+	// Create the accounts and discover their zones.
+	l, err := setupAccounts(ctx, cfg)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 		return
 	}
-	if strings.Contains(zonesFlag, ",") {
-		for _, z := range strings.Split(fs.Lookup("zones").Value.String(), ",") {
-			s := strings.SplitN(z, ":", 2)
-			if len(s) != 2 {
-				fmt.Printf("invalid zone \"%s\": missing `:` (zone_id:domain)\n", z)
+
+	if command == "preflight" || *runPreflight {
+		checks := preflight(ctx, l, cfg.Lag)
+		if printChecks(os.Stdout, checks) == 0 {
+			fmt.Println("none of the configured datasets can be read")
+
+			// Only refuse to start when Cloudflare rejected the credentials
+			// or they cannot see any of the zones, a transient failure such
+			// as an outage may have passed by the next collection.
+			if command == "preflight" || denied(checks) {
 				os.Exit(1)
 				return
 			}
-			zones = append(zones, s[0])
-			zoneIDMap[s[0]] = s[1]
 		}
-	} else {
-		s := strings.SplitN(zonesFlag, ":", 2)
-		if len(s) != 2 {
-			fmt.Printf("invalid zone \"%s\": missing `:` (zone_id:domain)\n", zonesFlag)
-			os.Exit(1)
+		if command == "preflight" {
 			return
 		}
-		zones = append(zones, s[0])
-		zoneIDMap[s[0]] = s[1]
 	}
 
-	var (
-		auth cloudflare.Auth
-		err  error
-	)
-	email, key := fs.Lookup("email"), fs.Lookup("key")
-	if email != nil && key != nil && email.Value.String() != "" && key.Value.String() != "" {
-		auth, err = cloudflare.NewKeyAuthorization(email.Value.String(), key.Value.String())
-	} else if token := fs.Lookup("token"); token != nil && token.Value.String() != "" {
-		auth, err = cloudflare.NewTokenAuthorization(token.Value.String())
-	}
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-		return
-	}
-	if auth == nil {
-		fmt.Println("no authentication method specified")
-		os.Exit(1)
-		return
-	}
-	cf, err = cloudflare.New(auth)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-		return
-	}
+	if cfg.StateFile != "" {
+		st, err := state.Load(cfg.StateFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+			return
+		}
+		col.Restore(st)
 
-	// Create a context that is cancelled by an interrupt signal.
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer cancel()
+		// Forget the zones that were removed while the exporter was stopped.
+		col.Retain(zonesOf(l))
+	}
 
 	// Start scraping metrics from Cloudflare.
-	go updateTask(ctx)
+	install(ctx, cfg, l)
+
+	// Reload the configuration on SIGHUP and optionally whenever it changes.
+	go reloadTask(ctx, fs)
+	if path := fs.Lookup("config").Value.String(); path != "" && *watch > 0 {
+		go watchTask(ctx, fs, path, *watch)
+	}
 
 	// Define a /metrics route.
-	http.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	http.Handle("/metrics", metricsHandler())
 
-		metrics.WritePrometheus(w, false)
-	}))
+	// Define a /probe route.
+	http.Handle("/probe", probeHandler())
+
+	// Define a /-/reload route.
+	if *enableReload {
+		http.Handle("/-/reload", reloadHandler(ctx, fs))
+	}
 
 	// Start the http server.
 	go func(ctx context.Context, bind string) {
-		fmt.Println("listening on :8089")
+		fmt.Println("listening on " + bind)
 		var lc net.ListenConfig
 		l, err := lc.Listen(ctx, "tcp", bind)
 		if err != nil {
@@ -167,107 +194,79 @@ func main() {
 			!strings.HasSuffix(err.Error(), " use of closed network connection") {
 			fmt.Println(err)
 		}
-	}(ctx, fs.Lookup("bind").Value.String())
+	}(ctx, cfg.Listen)
 
 	// Block until we receive a signal.
 	<-ctx.Done()
 	fmt.Println("received signal")
 	cancel()
-}
 
-func updateTask(ctx context.Context) {
-	// Initially fetch the metrics.
-	if err := fetchMetrics(ctx); err != nil {
-		fmt.Printf("failed to fetch metrics: %v\n", err)
+	// Wait for running collections to return so the state is consistent.
+	collecting.Wait()
+
+	if cfg := currentConfig(); cfg.StateFile != "" {
+		if err := state.Save(cfg.StateFile, col.Snapshot()); err != nil {
+			fmt.Printf("failed to save state: %v\n", err)
+		}
 	}
+}
 
-	// Make the ticker start at 0 seconds so it runs exactly when the minute
-	// changes.
-	time.Sleep(time.Duration(60-time.Now().Second()) * time.Second)
+// metricsHandler writes every series, scraping Cloudflare first when running in
+// scrape mode.
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	t := time.NewTicker(60 * time.Second)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				t.Stop()
-				return
-			case <-t.C:
-				go func() {
-					if err := fetchMetrics(ctx); err != nil {
-						fmt.Printf("failed to fetch metrics: %v\n", err)
-					}
-				}()
+		// Scrape first so the exporter's own metrics include this scrape.
+		var b bytes.Buffer
+		if s := currentScraper(); s != nil {
+			if err := s.WritePrometheus(r.Context(), &b); err != nil {
+				fmt.Printf("failed to scrape metrics: %v\n", err)
 			}
 		}
-	}()
+
+		metrics.WritePrometheus(w, false)
+		_, _ = w.Write(b.Bytes())
+	})
 }
 
-func fetchMetrics(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-	r, err := cf.Zone(
-		ctx,
-		zones,
-	)
-	if err != nil {
-		return err
+// expireTask periodically unregisters series that were not updated within ttl.
+func expireTask(ctx context.Context, ttl time.Duration) {
+	interval := time.Minute
+	if ttl < interval {
+		interval = ttl
 	}
-	cancel()
-
-	for _, z := range r.Viewer.Zones {
-		zone := zoneIDMap[z.ZoneID]
-		// for _, e := range z.FirewallEventsAdaptiveGroups {}
-		// for _, e := range z.HealthCheckEventsAdaptive {}
-
-		// HTTPRequests1mGroups
-		for _, e := range z.HTTPRequests1mGroups {
-			metrics.ZoneRequestsTotal(zone).Add(int(e.Sum.Requests))
-			metrics.ZoneRequestsCached(zone).Add(int(e.Sum.CachedRequests))
-			metrics.ZoneRequestsEncrypted(zone).Add(int(e.Sum.EncryptedRequests))
-
-			metrics.ZoneBandwidthTotal(zone).Add(int(e.Sum.Bytes))
-			metrics.ZoneBandwidthCached(zone).Add(int(e.Sum.CachedBytes))
-			metrics.ZoneBandwidthEncrypted(zone).Add(int(e.Sum.EncryptedBytes))
-
-			metrics.ZoneThreatsTotal(zone).Add(int(e.Sum.Threats))
+	t := time.NewTicker(interval)
+	defer t.Stop()
 
-			for _, ct := range e.Sum.ContentTypeMap {
-				metrics.ZoneRequestsContentType(zone, ct.EdgeResponseContentType).
-					Add(int(ct.Requests))
-				metrics.ZoneBandwidthContentType(zone, ct.EdgeResponseContentType).
-					Add(int(ct.Bytes))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if n := metrics.Expire(ttl); n > 0 {
+				metrics.ExporterSeriesExpired().Add(n)
+				fmt.Printf("expired %d series not updated for %s\n", n, ttl)
 			}
+		}
+	}
+}
 
-			for _, c := range e.Sum.CountryMap {
-				metrics.ZoneRequestsCountry(zone, c.ClientCountryName).
-					Add(int(c.Requests))
-				metrics.ZoneBandwidthCountry(zone, c.ClientCountryName).
-					Add(int(c.Bytes))
-				metrics.ZoneThreatsCountry(zone, c.ClientCountryName).
-					Add(int(c.Threats))
-			}
+func stateTask(ctx context.Context, path string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
 
-			for _, s := range e.Sum.ResponseStatusMap {
-				metrics.ZoneRequestsStatus(zone, strconv.Itoa(s.EdgeResponseStatus)).
-					Add(int(s.Requests))
-			}
-
-			for _, t := range e.Sum.ThreatPathingMap {
-				metrics.ZoneThreatsType(zone, t.Name).Add(int(t.Requests))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := state.Save(path, col.Snapshot()); err != nil {
+				fmt.Printf("failed to save state: %v\n", err)
 			}
 		}
-		// END HTTPRequests1mGroups
-
-		// HTTPRequestsAdaptiveGroups
-		for _, e := range z.HTTPRequestsAdaptiveGroups {
-			metrics.ZoneColocationVisits(zone, e.Dimensions.ColoCode).Add(int(e.Sum.Visits))
-			metrics.ZoneColocationResponseBytes(zone, e.Dimensions.ColoCode).
-				Add(int(e.Sum.EdgeResponseBytes))
-		}
-		// END HTTPRequestsAdaptiveGroups
-
-		// for _, e := range z.LoadBalancingRequestsAdaptive {}
 	}
-	return nil
 }
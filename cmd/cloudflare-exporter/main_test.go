@@ -0,0 +1,199 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare/fake"
+	"github.com/matthewpi/cloudflare-exporter/internal/collector"
+	"github.com/matthewpi/cloudflare-exporter/internal/config"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+)
+
+func TestMetricsEndToEnd(t *testing.T) {
+	start(t, "e2e", "a.example", config.ModeBackground)
+
+	h := httptest.NewServer(metricsHandler())
+	defer h.Close()
+
+	waitFor(t, h.URL, `cloudflare_zone_requests_total{account="e2e",zone="a.example"} 5`)
+}
+
+func TestReloadToScrapeMode(t *testing.T) {
+	ctx, cfg, _ := start(t, "mode", "z.example", config.ModeBackground)
+
+	h := httptest.NewServer(metricsHandler())
+	defer h.Close()
+
+	series := `cloudflare_zone_requests_total{account="mode",zone="z.example"}`
+	waitFor(t, h.URL, series+" 5")
+
+	// Switch to scrape mode, the series is only written by the scrape.
+	scrape := *cfg
+	scrape.Mode = config.ModeScrape
+	l, err := setupAccounts(ctx, &scrape)
+	if err != nil {
+		t.Fatal(err)
+	}
+	install(ctx, &scrape, l)
+
+	body := get(t, h.URL)
+	if n := strings.Count(body, series+" "); n != 1 {
+		t.Fatalf("expected %s once, got it %d times in:\n%s", series, n, body)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	_, cfg, srv := start(t, "probe", "p.example", config.ModeScrape)
+	srv.AddZone(cloudflare.ZoneInfo{ID: "other", Name: "other.example"})
+	srv.FailDataset("id", cloudflare.DatasetHTTPRequests1m, "zone does not have access to the path")
+	cfg.ScrapeCache = 0
+
+	h := httptest.NewServer(probeHandler())
+	defer h.Close()
+
+	// Zones that are not configured for the account are never queried.
+	res, err := http.Get(h.URL + "?zone=other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected probing an unknown zone to fail, got %s", res.Status)
+	}
+	if n := srv.Requests(); n != 0 {
+		t.Errorf("expected no requests for an unknown zone, got %d", n)
+	}
+
+	// The exporter series of a probe are only written by the probe, and its
+	// errors do not cause the zone to be skipped.
+	errs := `cloudflare_exporter_zone_errors_total{account="probe",zone="p.example",dataset="httpRequests1mGroups",kind="permission"} 1`
+	for i := 1; i <= 2; i++ {
+		if body := get(t, h.URL+"?zone=id"); !strings.Contains(body, errs) {
+			t.Errorf("expected %s in:\n%s", errs, body)
+		}
+		if n := srv.Requests(); n != i {
+			t.Errorf("expected %d requests, got %d", i, n)
+		}
+	}
+
+	var b bytes.Buffer
+	metrics.WritePrometheus(&b, false)
+	if strings.Contains(b.String(), `account="probe",zone=`) {
+		t.Errorf("expected the probe to leave no global series of the zone:\n%s", b.String())
+	}
+}
+
+// start installs a configuration collecting a zone with 5 requests every
+// minute from a fake API in the mode. The tasks are stopped when the test
+// finishes.
+func start(t *testing.T, account, zone, mode string) (context.Context, *config.Config, *fake.Server) {
+	t.Helper()
+
+	_, srv := fake.NewClient(t)
+	cfg := newConfig(t, srv, account, zone, mode)
+
+	// Fill the minutes around the collected one, so the test does not depend
+	// on which minute is the most recent complete one.
+	now := time.Now().Add(-cfg.Lag).UTC().Truncate(time.Minute)
+	srv.AddZone(cloudflare.ZoneInfo{ID: "id", Name: zone})
+	for i := -3; i <= 1; i++ {
+		var z cloudflare.Zone
+		z.HTTPRequests1mGroups = []cloudflare.HTTPRequest1m{{}}
+		z.HTTPRequests1mGroups[0].Sum.Requests = 5
+		srv.AddRows("id", now.Add(time.Duration(i)*time.Minute), z)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		collecting.Wait()
+	})
+
+	col = fake.NewCollector(cfg.Lag, cfg.Lookback, collector.Zone{Account: account, Name: zone})
+	l, err := setupAccounts(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	install(ctx, cfg, l)
+	return ctx, cfg, srv
+}
+
+// newConfig returns a configuration collecting the requests of a zone with the
+// ID "id" from the fake API in the mode.
+func newConfig(t *testing.T, srv *fake.Server, account, zone, mode string) *config.Config {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.APIURL = srv.URL
+	cfg.Mode = mode
+	cfg.Accounts = []*config.Account{{
+		Name:  account,
+		Token: fake.Token,
+		Zones: []*config.Zone{{ID: "id", Name: zone}},
+	}}
+	cfg.Datasets = []cloudflare.Dataset{cloudflare.DatasetHTTPRequests1m}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// get returns the body of the response to a GET request of url.
+func get(t *testing.T, url string) string {
+	t.Helper()
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// waitFor polls url until the body of its response contains want.
+func waitFor(t *testing.T, url, want string) {
+	t.Helper()
+
+	var body string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if body = get(t, url); strings.Contains(body, want) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("expected %s in:\n%s", want, body)
+}
@@ -0,0 +1,190 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+)
+
+// check is the outcome of checking whether a dataset of a zone can be read.
+type check struct {
+	account string
+	zone    string
+	dataset cloudflare.Dataset
+
+	// err is the reason the dataset cannot be read, nil if it can.
+	err error
+}
+
+// preflight verifies the API token of every account and checks whether each
+// dataset of every exported zone can be read, by querying the most recent
+// complete minute.
+func preflight(ctx context.Context, l []*account, lag time.Duration) []check {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	end := time.Now().Add(-lag).UTC().Truncate(time.Minute)
+	zones := zonesOf(l)
+
+	var checks []check
+	for _, a := range l {
+		// Group the zones of the account that collect the same datasets.
+		queries := map[string]*cloudflare.Query{}
+		names := map[string]string{}
+		var keys []string
+		for _, z := range zones {
+			if z.Account != a.cfg.Name {
+				continue
+			}
+			names[z.ID] = z.Name
+
+			datasets := z.Datasets
+			if len(datasets) == 0 {
+				datasets = cloudflare.Datasets
+			}
+			k := fmt.Sprint(datasets)
+			q, ok := queries[k]
+			if !ok {
+				q = &cloudflare.Query{Datasets: datasets, Start: end.Add(-time.Minute), End: end}
+				queries[k] = q
+				keys = append(keys, k)
+			}
+			q.Zones = append(q.Zones, z.ID)
+		}
+
+		// Nothing can be read with a token that is not active.
+		var tokenErr error
+		if a.cfg.HasToken() && len(keys) > 0 {
+			status, err := a.cf.VerifyToken(ctx)
+			if err == nil && !status.Active() {
+				err = &cloudflare.Error{
+					Kind:    cloudflare.ErrorAuth,
+					Message: "token is " + status.Status,
+				}
+			}
+			tokenErr = err
+		}
+
+		for _, k := range keys {
+			q := queries[k]
+
+			var (
+				r   cloudflare.Response
+				err = tokenErr
+			)
+			if err == nil {
+				r, err = a.cf.Query(ctx, *q)
+			}
+
+			failed := map[string]map[cloudflare.Dataset]error{}
+			for _, id := range q.Zones {
+				failed[id] = map[cloudflare.Dataset]error{}
+				for _, d := range q.Datasets {
+					failed[id][d] = err
+				}
+			}
+			for _, e := range r.Errors {
+				for _, id := range q.Zones {
+					if e.ZoneID != "" && e.ZoneID != id {
+						continue
+					}
+					for _, d := range q.Datasets {
+						if e.Dataset == "" || e.Dataset == d {
+							failed[id][d] = e
+						}
+					}
+				}
+			}
+
+			for _, id := range q.Zones {
+				for _, d := range q.Datasets {
+					checks = append(checks, check{
+						account: a.cfg.Name,
+						zone:    names[id],
+						dataset: d,
+						err:     failed[id][d],
+					})
+				}
+			}
+		}
+	}
+	return checks
+}
+
+// printChecks writes a table of the checks to w and returns the number of
+// datasets that can be read.
+func printChecks(w io.Writer, checks []check) int {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tZONE\tDATASET\tCOLLECTED\tREASON")
+
+	var n int
+	for _, c := range checks {
+		collected, reason := "yes", ""
+		if c.err != nil {
+			collected, reason = "no", c.err.Error()
+			var e *cloudflare.Error
+			if errors.As(c.err, &e) {
+				reason = string(e.Kind) + ": " + e.Message
+			}
+		} else {
+			n++
+		}
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\t%s\t%s\n",
+			c.account,
+			c.zone,
+			c.dataset,
+			collected,
+			strings.ReplaceAll(reason, "\n", " "),
+		)
+	}
+	_ = tw.Flush()
+	return n
+}
+
+// denied reports whether every check failed because the credentials are invalid,
+// not allowed to read the dataset or cannot see the zone.
+func denied(checks []check) bool {
+	for _, c := range checks {
+		var e *cloudflare.Error
+		if !errors.As(c.err, &e) {
+			return false
+		}
+		switch e.Kind {
+		case cloudflare.ErrorAuth, cloudflare.ErrorPermission, cloudflare.ErrorZoneNotFound:
+		default:
+			return false
+		}
+	}
+	return len(checks) > 0
+}
@@ -0,0 +1,71 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare/fake"
+	"github.com/matthewpi/cloudflare-exporter/internal/config"
+)
+
+func TestPreflight(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		zone   bool
+		read   int
+		denied bool
+	}{
+		{name: "active", status: "active", zone: true, read: 1},
+		{name: "disabled", status: "disabled", zone: true, denied: true},
+		{name: "no zone access", status: "active", denied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := fake.NewClient(t)
+			srv.SetTokenStatus(tt.status)
+			if tt.zone {
+				srv.AddZone(cloudflare.ZoneInfo{ID: "id", Name: "preflight.example"})
+			}
+
+			ctx := context.Background()
+			cfg := newConfig(t, srv, "preflight", "preflight.example", config.ModeBackground)
+			l, err := setupAccounts(ctx, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checks := preflight(ctx, l, cfg.Lag)
+			if n := printChecks(io.Discard, checks); n != tt.read {
+				t.Errorf("expected %d readable datasets, got %d: %v", tt.read, n, checks)
+			}
+			if d := denied(checks); d != tt.denied {
+				t.Errorf("expected denied to be %t, got %t: %v", tt.denied, d, checks)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/collector"
+	"github.com/matthewpi/cloudflare-exporter/internal/config"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+)
+
+// probeIdle is how long a probed zone is cached for after its last probe.
+const probeIdle = 10 * time.Minute
+
+var (
+	probesMu sync.Mutex
+
+	// probes holds a scraper for every probed module and zone, so repeated
+	// probes share the scrape cache.
+	probes = map[string]*probe{}
+)
+
+// probe .
+type probe struct {
+	scraper *collector.Scraper
+	used    time.Time
+}
+
+// resetProbes forgets every probed zone, their scrapers use the clients of the
+// previous configuration.
+func resetProbes() {
+	probesMu.Lock()
+	probes = map[string]*probe{}
+	probesMu.Unlock()
+}
+
+// getProbe returns the scraper for the module and zone, creating it if the
+// zone has not been probed recently.
+func getProbe(cfg *config.Config, module string, zone collector.Zone) *collector.Scraper {
+	probesMu.Lock()
+	defer probesMu.Unlock()
+
+	now := time.Now()
+	for k, p := range probes {
+		if now.Sub(p.used) > probeIdle {
+			delete(probes, k)
+		}
+	}
+
+	k := module + "/" + zone.ID
+	p, ok := probes[k]
+	if !ok {
+		p = &probe{
+			scraper: collector.NewProbe(col, zone, cfg.ScrapeCache, cfg.CollectTimeout),
+		}
+		probes[k] = p
+	}
+	p.used = now
+	return p.scraper
+}
+
+// probeZone returns the zone to probe using the credentials and datasets of the
+// module. If no modules are configured and there is a single account, the
+// module may be omitted.
+//
+// Only zones configured or discovered for the module's account can be probed,
+// otherwise anyone able to reach the endpoint could query any zone.
+func probeZone(cfg *config.Config, module, id string) (collector.Zone, error) {
+	var m config.Module
+	switch mm, ok := cfg.Modules[module]; {
+	case ok:
+		m = *mm
+	case module == "" && len(cfg.Modules) == 0 && len(cfg.Accounts) == 1:
+		m.Account = cfg.Accounts[0].Name
+	case module == "":
+		return collector.Zone{}, errors.New("module parameter is missing")
+	default:
+		return collector.Zone{}, errors.Errorf("unknown module \"%s\"", module)
+	}
+
+	accountsMu.RLock()
+	defer accountsMu.RUnlock()
+	for _, a := range accounts {
+		if a.cfg.Name != m.Account {
+			continue
+		}
+
+		var (
+			zone  collector.Zone
+			found bool
+		)
+		a.mu.RLock()
+		for _, z := range a.zones {
+			if z.ID == id {
+				zone, found = z, true
+				break
+			}
+		}
+		a.mu.RUnlock()
+		if !found {
+			return collector.Zone{}, errors.Errorf("unknown zone \"%s\" for account \"%s\"", id, a.cfg.Name)
+		}
+
+		if len(m.Datasets) > 0 {
+			zone.Datasets = m.Datasets
+		}
+		return zone, nil
+	}
+	return collector.Zone{}, errors.Errorf("unknown account \"%s\"", m.Account)
+}
+
+// probeHandler collects the metrics of a single zone, identified by the zone
+// parameter, using the module named by the module parameter.
+func probeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		id := q.Get("zone")
+		if id == "" {
+			http.Error(w, "zone parameter is missing", http.StatusBadRequest)
+			return
+		}
+		cfg := currentConfig()
+		module := q.Get("module")
+		zone, err := probeZone(cfg, module, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		started := time.Now()
+		var b bytes.Buffer
+		err = getProbe(cfg, module, zone).WritePrometheus(r.Context(), &b)
+		if err != nil {
+			fmt.Printf("failed to probe zone %s: %v\n", zone.Name, err)
+		}
+
+		metrics.WriteProbe(w, err == nil, time.Since(started))
+		_, _ = w.Write(b.Bytes())
+	})
+}
@@ -0,0 +1,258 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/collector"
+	"github.com/matthewpi/cloudflare-exporter/internal/config"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+)
+
+var (
+	// reloadMu is held while a configuration is being applied, so reloads
+	// never run concurrently.
+	reloadMu sync.Mutex
+
+	// stopTasks stops every task started for the current configuration.
+	stopTasks context.CancelFunc
+
+	// collecting tracks the running schedulers, so shutdown can wait for
+	// collections to be cancelled before saving the state.
+	collecting sync.WaitGroup
+
+	// currentMu guards current and scraper. It is only held to read or swap
+	// them, so handlers are never blocked by a reload in progress.
+	currentMu sync.RWMutex
+
+	// current is the currently applied configuration.
+	current *config.Config
+
+	// scraper collects whenever metrics are scraped, if running in scrape
+	// mode.
+	scraper *collector.Scraper
+)
+
+// currentConfig returns the currently applied configuration.
+func currentConfig() *config.Config {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	return current
+}
+
+// currentScraper returns the scraper of the current configuration, or nil if
+// metrics are collected in the background.
+func currentScraper() *collector.Scraper {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	return scraper
+}
+
+// apply creates the accounts of cfg and installs them.
+//
+// If an error is returned the current configuration is left untouched.
+func apply(ctx context.Context, cfg *config.Config) error {
+	l, err := setupAccounts(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	install(ctx, cfg, l)
+	return nil
+}
+
+// setupAccounts creates the accounts of cfg and discovers their zones.
+func setupAccounts(ctx context.Context, cfg *config.Config) ([]*account, error) {
+	l, err := newAccounts(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range l {
+		if a.cfg.Discover == nil {
+			continue
+		}
+		n, err := a.discover(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to discover zones for account %s", a.cfg.Name)
+		}
+		if n == 0 {
+			return nil, errors.Errorf("no zones discovered for account %s", a.cfg.Name)
+		}
+		fmt.Printf("discovered %d zones for account %s\n", n, a.cfg.Name)
+	}
+	return l, nil
+}
+
+// install swaps the accounts in place of the current accounts, then restarts
+// every task. Series belonging to zones that are no longer exported are removed
+// while counters of the remaining zones are kept.
+func install(ctx context.Context, cfg *config.Config, l []*account) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if c := currentConfig(); c != nil && c.Listen != cfg.Listen {
+		fmt.Println("changing the listen address requires a restart")
+	}
+
+	// Cancel the tasks of the previous configuration first, so reconfiguring
+	// the collector does not wait for a running collection to finish.
+	if stopTasks != nil {
+		stopTasks()
+	}
+	collecting.Wait()
+
+	old := getZones()
+	accountsMu.Lock()
+	accounts = l
+	accountsMu.Unlock()
+	col.Configure(cfg.Lag, cfg.Lookback)
+	col.Prune(old, getZones())
+	resetProbes()
+
+	metrics.ExporterZones().Set(float64(len(getZones())))
+	metrics.ExporterRowsLimit().Set(float64(cfg.Limit))
+
+	ctx, stopTasks = context.WithCancel(ctx)
+
+	// Periodically refresh the discovered zones.
+	for _, a := range l {
+		if a.cfg.Discover != nil {
+			go a.discoverTask(ctx)
+		}
+	}
+
+	// Periodically remove series that are no longer updated.
+	if cfg.SeriesTTL > 0 {
+		go expireTask(ctx, cfg.SeriesTTL)
+	}
+
+	// Collect metrics from Cloudflare when scraped. Every scrape writes the
+	// zones' series itself, so remove any collected in the background, along
+	// with the windows they ingested, or they would be written twice.
+	if cfg.Mode == config.ModeScrape {
+		col.Retain(nil)
+		s := collector.NewScraper(col, getZones, cfg.ScrapeCache, cfg.CollectTimeout)
+		currentMu.Lock()
+		current, scraper = cfg, s
+		currentMu.Unlock()
+		return
+	}
+	currentMu.Lock()
+	current, scraper = cfg, nil
+	currentMu.Unlock()
+
+	// Start scraping metrics from Cloudflare.
+	collecting.Add(1)
+	go func(ctx context.Context) {
+		defer collecting.Done()
+		collector.NewScheduler(col, getZones, cfg.Interval, cfg.CollectTimeout).Run(ctx)
+	}(ctx)
+
+	// Periodically persist the state.
+	if cfg.StateFile != "" {
+		go stateTask(ctx, cfg.StateFile, cfg.StateInterval)
+	}
+}
+
+// reload loads the configuration again and applies it.
+func reload(ctx context.Context, fs *flag.FlagSet) error {
+	cfg, err := loadConfig(fs)
+	if err != nil {
+		return err
+	}
+	if err := apply(ctx, cfg); err != nil {
+		return err
+	}
+	fmt.Println("reloaded configuration")
+	return nil
+}
+
+// reloadTask reloads the configuration whenever a SIGHUP is received.
+func reloadTask(ctx context.Context, fs *flag.FlagSet) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			if err := reload(ctx, fs); err != nil {
+				fmt.Printf("failed to reload configuration: %v\n", err)
+			}
+		}
+	}
+}
+
+// watchTask reloads the configuration whenever the contents of the file at
+// path change.
+func watchTask(ctx context.Context, fs *flag.FlagSet, path string, interval time.Duration) {
+	last, _ := os.ReadFile(path)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			b, err := os.ReadFile(path)
+			if err != nil || bytes.Equal(b, last) {
+				continue
+			}
+			last = b
+
+			if err := reload(ctx, fs); err != nil {
+				fmt.Printf("failed to reload configuration: %v\n", err)
+			}
+		}
+	}
+}
+
+// reloadHandler reloads the configuration on a POST request.
+func reloadHandler(ctx context.Context, fs *flag.FlagSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := reload(ctx, fs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,277 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/collector"
+	"github.com/matthewpi/cloudflare-exporter/internal/config"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+)
+
+var (
+	accountsMu sync.RWMutex
+
+	// accounts holds every configured account.
+	accounts []*account
+)
+
+// account is a configured Cloudflare account along with the zones exported
+// for it.
+type account struct {
+	cfg      *config.Account
+	cf       *cloudflare.Cloudflare
+	datasets []cloudflare.Dataset
+
+	mu    sync.RWMutex
+	zones []collector.Zone
+}
+
+// newAccounts creates a client for every account in cfg.
+func newAccounts(cfg *config.Config) ([]*account, error) {
+	l := make([]*account, 0, len(cfg.Accounts))
+	for _, c := range cfg.Accounts {
+		auth, err := newAuth(c)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := []cloudflare.Option{
+			cloudflare.WithURL(cfg.APIURL),
+			cloudflare.WithBatchSize(cfg.BatchSize),
+			cloudflare.WithConcurrency(cfg.Concurrency),
+			cloudflare.WithLimit(cfg.Limit),
+			cloudflare.WithTimeout(cfg.Timeout),
+			cloudflare.WithRetries(cfg.Retries),
+			cloudflare.WithRateLimit(cfg.RateLimit, cfg.RateBurst),
+		}
+		if cfg.Record != "" {
+			opts = append(opts, cloudflare.WithRecord(cfg.Record))
+		}
+		if cfg.Replay != "" {
+			opts = append(opts, cloudflare.WithReplay(cfg.Replay))
+		}
+
+		cf, err := cloudflare.New(auth, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		a := &account{cfg: c, cf: cf, datasets: cfg.Datasets}
+		a.setZones(nil)
+		l = append(l, a)
+	}
+	return l, nil
+}
+
+// newAuth returns the authorization of the account, failing if any of its
+// secrets cannot be read.
+func newAuth(c *config.Account) (cloudflare.Auth, error) {
+	switch {
+	case c.Token != "":
+		return cloudflare.NewTokenAuthorization(c.Token)
+	case c.TokenFrom == nil && c.KeyFrom == nil:
+		return cloudflare.NewKeyAuthorization(c.Email, c.Key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if c.TokenFrom != nil {
+		token, err := c.TokenFrom.Source()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := token.Get(ctx); err != nil {
+			return nil, errors.Wrapf(err, "failed to read token of account %s", c.Name)
+		}
+		return cloudflare.NewSecretTokenAuthorization(token)
+	}
+
+	key, err := c.KeyFrom.Source()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := key.Get(ctx); err != nil {
+		return nil, errors.Wrapf(err, "failed to read key of account %s", c.Name)
+	}
+	return cloudflare.NewSecretKeyAuthorization(cloudflare.StaticSecret(c.Email), key)
+}
+
+// getZones returns the exported zones of every account.
+//
+// A zone visible to several accounts is only exported once, preferring an
+// account that configures the zone over one that discovered it, and otherwise
+// the account that is configured first.
+func getZones() []collector.Zone {
+	accountsMu.RLock()
+	defer accountsMu.RUnlock()
+	return zonesOf(accounts)
+}
+
+// zonesOf returns the exported zones of the accounts, see getZones.
+func zonesOf(l []*account) []collector.Zone {
+	configured := map[string]struct{}{}
+	for _, a := range l {
+		for _, z := range a.cfg.Zones {
+			configured[z.ID] = struct{}{}
+		}
+	}
+
+	var zones []collector.Zone
+	seen := map[string]struct{}{}
+	for _, a := range l {
+		a.mu.RLock()
+		for _, z := range a.zones {
+			if _, ok := seen[z.ID]; ok {
+				continue
+			}
+			if _, ok := configured[z.ID]; ok && !a.configures(z.ID) {
+				continue
+			}
+			seen[z.ID] = struct{}{}
+			zones = append(zones, z)
+		}
+		a.mu.RUnlock()
+	}
+	return zones
+}
+
+// configures reports whether the zone is configured for the account.
+func (a *account) configures(id string) bool {
+	for _, z := range a.cfg.Zones {
+		if z.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// setZones replaces the exported zones of the account with the configured
+// zones and the discovered zones, a map of zone ID to name.
+func (a *account) setZones(discovered map[string]string) {
+	l := make([]collector.Zone, 0, len(a.cfg.Zones)+len(discovered))
+
+	// Configured zones take precedence so their display names can be
+	// overridden.
+	configured := make(map[string]struct{}, len(a.cfg.Zones))
+	for _, z := range a.cfg.Zones {
+		configured[z.ID] = struct{}{}
+		datasets := z.Datasets
+		if len(datasets) == 0 {
+			datasets = a.datasets
+		}
+		l = append(l, collector.Zone{
+			ID:       z.ID,
+			Account:  a.cfg.Name,
+			Name:     z.Name,
+			Labels:   z.Labels,
+			Datasets: datasets,
+			Client:   a.cf,
+		})
+	}
+	for id, name := range discovered {
+		if _, ok := configured[id]; ok {
+			continue
+		}
+		l = append(l, collector.Zone{
+			ID:       id,
+			Account:  a.cfg.Name,
+			Name:     name,
+			Datasets: a.datasets,
+			Client:   a.cf,
+		})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].ID < l[j].ID
+	})
+
+	a.mu.Lock()
+	a.zones = l
+	a.mu.Unlock()
+}
+
+// discover lists the zones visible to the account and exports every zone
+// matched by its filter along with the configured zones.
+func (a *account) discover(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	res, err := a.cf.ListZones(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	filter := a.cfg.Discover.Filter()
+	m := make(map[string]string, len(res))
+	for _, z := range res {
+		if filter.Match(z) {
+			m[z.ID] = z.Name
+		}
+	}
+	a.setZones(m)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.zones), nil
+}
+
+func (a *account) discoverTask(ctx context.Context) {
+	t := time.NewTicker(a.cfg.Discover.Interval)
+	defer t.Stop()
+
+	a.mu.RLock()
+	last := len(a.zones)
+	a.mu.RUnlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			old := getZones()
+			n, err := a.discover(ctx)
+			if err != nil {
+				fmt.Printf("failed to discover zones for account %s: %v\n", a.cfg.Name, err)
+				continue
+			}
+			col.Prune(old, getZones())
+			metrics.ExporterZones().Set(float64(len(getZones())))
+			if n != last {
+				fmt.Printf(
+					"discovered %d zones for account %s (previously %d)\n",
+					n,
+					a.cfg.Name,
+					last,
+				)
+				last = n
+			}
+		}
+	}
+}
@@ -4,7 +4,6 @@ go 1.16
 
 require (
 	github.com/VictoriaMetrics/metrics v1.18.1
-	github.com/machinebox/graphql v0.2.2
-	github.com/matryer/is v1.4.0 // indirect
 	github.com/pkg/errors v0.9.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -24,302 +24,539 @@
 package cloudflare
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/machinebox/graphql"
 	"github.com/pkg/errors"
 )
 
+// DefaultURL is the base URL of the Cloudflare v4 API.
+const DefaultURL = "https://api.cloudflare.com/client/v4"
+
 // Cloudflare .
 type Cloudflare struct {
 	// Auth .
 	Auth Auth
 
-	// graphql .
-	graphql *graphql.Client
+	// http .
+	http *http.Client
+
+	// url is the base URL of the API.
+	url string
+
+	// batchSize is the maximum number of zones sent in a single query.
+	batchSize int
+
+	// concurrency is the maximum number of queries running at once.
+	concurrency int
+
+	// limit is the maximum number of rows requested per zone and dataset.
+	limit int
+
+	// timeout is the timeout of a single attempt of a request.
+	timeout time.Duration
+
+	// retries is the maximum number of times a failed request is retried.
+	retries int
+
+	// rate is the maximum number of requests per second, and burst the
+	// number of requests that may be sent at once before being limited.
+	rate  float64
+	burst int
+
+	// record is the directory every response is recorded to, and replay the
+	// directory responses are served from instead of the API.
+	record string
+	replay string
+}
+
+// Option .
+type Option func(*Cloudflare)
+
+// WithURL sets the base URL of the API, such as a proxy or a fake server.
+func WithURL(u string) Option {
+	return func(cf *Cloudflare) {
+		cf.url = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithBatchSize sets the maximum number of zones sent in a single query.
+func WithBatchSize(n int) Option {
+	return func(cf *Cloudflare) {
+		cf.batchSize = n
+	}
+}
+
+// WithConcurrency sets the maximum number of queries running at once.
+func WithConcurrency(n int) Option {
+	return func(cf *Cloudflare) {
+		cf.concurrency = n
+	}
+}
+
+// WithLimit sets the maximum number of rows requested per zone and dataset,
+// Cloudflare does not allow more than 10,000.
+func WithLimit(n int) Option {
+	return func(cf *Cloudflare) {
+		cf.limit = n
+	}
+}
+
+// WithTimeout sets the timeout of a single attempt of a request.
+func WithTimeout(d time.Duration) Option {
+	return func(cf *Cloudflare) {
+		cf.timeout = d
+	}
+}
+
+// WithRetries sets the maximum number of times a request that failed with a
+// transient error is retried.
+func WithRetries(n int) Option {
+	return func(cf *Cloudflare) {
+		cf.retries = n
+	}
+}
+
+// WithRateLimit limits the requests sent by the client to rate per second,
+// allowing bursts of up to burst requests. A rate of 0 disables the limit.
+//
+// The limit is shared by every query made using the client.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(cf *Cloudflare) {
+		cf.rate, cf.burst = rate, burst
+	}
 }
 
 // New .
-func New(auth Auth) (*Cloudflare, error) {
-	return &Cloudflare{
+func New(auth Auth, opts ...Option) (*Cloudflare, error) {
+	cf := &Cloudflare{
 		Auth: auth,
 
-		graphql: graphql.NewClient("https://api.cloudflare.com/client/v4/graphql"),
-	}, nil
+		url: DefaultURL,
+
+		batchSize:   10,
+		concurrency: 4,
+		limit:       1000,
+		timeout:     30 * time.Second,
+		retries:     3,
+		rate:        4,
+		burst:       10,
+	}
+	for _, opt := range opts {
+		opt(cf)
+	}
+	if u, err := url.Parse(cf.url); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("cloudflare: url must be an absolute URL")
+	}
+	if cf.batchSize < 1 {
+		return nil, errors.New("cloudflare: batch size must be at least 1")
+	}
+	if cf.concurrency < 1 {
+		return nil, errors.New("cloudflare: concurrency must be at least 1")
+	}
+	if cf.limit < 1 || cf.limit > 10000 {
+		return nil, errors.New("cloudflare: limit must be between 1 and 10000")
+	}
+	if cf.timeout < 0 {
+		return nil, errors.New("cloudflare: timeout must not be negative")
+	}
+	if cf.retries < 0 {
+		return nil, errors.New("cloudflare: retries must not be negative")
+	}
+	if cf.rate < 0 {
+		return nil, errors.New("cloudflare: rate limit must not be negative")
+	}
+
+	if cf.record != "" && cf.replay != "" {
+		return nil, errors.New("cloudflare: cannot record and replay at the same time")
+	}
+
+	base, _ := url.Parse(cf.url)
+	var next http.RoundTripper = retryTransport{
+		next:    http.DefaultTransport,
+		limiter: newLimiter(cf.rate, cf.burst),
+		retries: cf.retries,
+		timeout: cf.timeout,
+	}
+	switch {
+	case cf.record != "":
+		t, err := newRecordTransport(next, cf.record, base.Path)
+		if err != nil {
+			return nil, err
+		}
+		next = t
+	case cf.replay != "":
+		t, err := newReplayTransport(cf.replay, base.Path)
+		if err != nil {
+			return nil, err
+		}
+		next = t
+	}
+	cf.http = &http.Client{
+		Transport: countingTransport{next: next},
+	}
+	return cf, nil
+}
+
+// Query .
+type Query struct {
+	// Zones .
+	Zones []string
+
+	// Datasets to query, if empty every dataset is queried.
+	Datasets []Dataset
+
+	// Start (inclusive) and End (exclusive) of the window to query.
+	Start time.Time
+	End   time.Time
+}
+
+// Query queries the datasets of every zone in q.
+//
+// Zones are split into batches which are queried concurrently. If a zone
+// returns as many rows as the limit for a dataset, the window is split in half
+// and queried again until either fewer rows are returned or the window can no
+// longer be split, in which case the Truncation is reported on the Response.
+//
+// Errors that only affect some zones or datasets are reported on the Response
+// alongside the data of every zone that succeeded, an error is only returned
+// if every batch failed.
+func (cf *Cloudflare) Query(ctx context.Context, q Query) (Response, error) {
+	datasets := q.Datasets
+	if len(datasets) == 0 {
+		datasets = Datasets
+	}
+
+	var n int64
+	ctx = context.WithValue(ctx, bytesKey{}, &n)
+
+	var batches [][]string
+	for i := 0; i < len(q.Zones); i += cf.batchSize {
+		end := i + cf.batchSize
+		if end > len(q.Zones) {
+			end = len(q.Zones)
+		}
+		batches = append(batches, q.Zones[i:end])
+	}
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, cf.concurrency)
+		results = make([]Response, len(batches))
+		errs    = make([]error, len(batches))
+	)
+	for i, zones := range batches {
+		wg.Add(1)
+		go func(i int, zones []string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			results[i], errs[i] = cf.batch(ctx, zones, datasets, q.Start, q.End)
+		}(i, zones)
+	}
+	wg.Wait()
+
+	var (
+		resp   Response
+		failed error
+	)
+	for i, r := range results {
+		if err := errs[i]; err != nil {
+			failed = err
+			for _, z := range batches[i] {
+				resp.Errors = append(resp.Errors, zoneError(err, z))
+			}
+			continue
+		}
+		resp.Viewer.Zones = append(resp.Viewer.Zones, r.Viewer.Zones...)
+		resp.Truncated = append(resp.Truncated, r.Truncated...)
+		resp.Errors = append(resp.Errors, r.Errors...)
+	}
+	if failed != nil && len(resp.Viewer.Zones) == 0 {
+		return Response{}, failed
+	}
+	resp.Bytes = atomic.LoadInt64(&n)
+	return resp, nil
 }
 
-// Zone .
-func (cf *Cloudflare) Zone(ctx context.Context, zones []string) (Response, error) {
-	r := graphql.NewRequest(`
-		query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!) {
-			viewer {
-				zones (filter: { zoneTag_in: $zoneIDs }) {
-					zoneTag
-
-					httpRequests1mGroups (limit: $limit, filter: { datetime: $maxtime }) {
-						uniq {
-							uniques
-						}
-
-						sum {
-							browserMap {
-								pageViews
-								uaBrowserFamily
-							}
-
-							bytes
-							cachedBytes
-							cachedRequests
-
-							clientHTTPVersionMap {
-								clientHTTPProtocol
-								requests
-							}
-
-							clientSSLMap {
-								clientSSLProtocol
-								requests
-							}
-
-							contentTypeMap {
-								bytes
-								requests
-								edgeResponseContentTypeName
-							}
-
-							countryMap {
-								bytes
-								clientCountryName
-								requests
-								threats
-							}
-
-							encryptedBytes
-							encryptedRequests
-
-							ipClassMap {
-								ipType
-								requests
-							}
-
-							pageViews
-							requests
-
-							responseStatusMap {
-								edgeResponseStatus
-								requests
-							}
-
-							threatPathingMap {
-								requests
-								threatPathingName
-							}
-
-							threats
-						}
-
-						dimensions {
-							datetime
-						}
-					}
-
-					httpRequestsAdaptiveGroups (limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
-						count
-
-						avg {
-							sampleInterval
-						}
-
-						dimensions {
-							coloCode
-							datetime
-						}
-
-						sum {
-							edgeResponseBytes
-							visits
-						}
-					}
-				}
+// batch queries a single batch of zones, paging through any dataset that
+// reached the limit.
+func (cf *Cloudflare) batch(
+	ctx context.Context,
+	zones []string,
+	datasets []Dataset,
+	start, end time.Time,
+) (Response, error) {
+	resp, err := cf.fetch(ctx, zones, datasets, start, end)
+	if err != nil {
+		return Response{}, err
+	}
+
+	found := make(map[string]struct{}, len(resp.Viewer.Zones))
+	for i := range resp.Viewer.Zones {
+		z := &resp.Viewer.Zones[i]
+		found[z.ZoneID] = struct{}{}
+		for _, d := range datasets {
+			t, e, err := cf.split(ctx, z, d, start, end)
+			if err != nil {
+				return Response{}, err
 			}
+			resp.Truncated = append(resp.Truncated, t...)
+			resp.Errors = append(resp.Errors, e...)
+		}
+	}
+
+	// Cloudflare silently omits zones that do not exist.
+	for _, e := range resp.Errors {
+		if e.Dataset == "" {
+			found[e.ZoneID] = struct{}{}
+		}
+	}
+	for _, z := range zones {
+		if _, ok := found[z]; !ok {
+			resp.Errors = append(resp.Errors, &Error{
+				Kind:    ErrorZoneNotFound,
+				Message: "zone was not returned",
+				ZoneID:  z,
+			})
+		}
+	}
+	return resp, nil
+}
+
+// split replaces the rows z has for the dataset by querying both halves of the
+// window if the limit was reached.
+func (cf *Cloudflare) split(
+	ctx context.Context,
+	z *Zone,
+	d Dataset,
+	start, end time.Time,
+) ([]Truncation, []*Error, error) {
+	if z.Rows(d) < cf.limit {
+		return nil, nil, nil
+	}
+	mid := start.Add(end.Sub(start) / 2).Truncate(d.granularity())
+	if !mid.After(start) {
+		return []Truncation{{ZoneID: z.ZoneID, Dataset: d, Start: start, End: end}}, nil, nil
+	}
+
+	var (
+		truncated []Truncation
+		errs      []*Error
+	)
+	z.Clear(d)
+	for _, w := range [][2]time.Time{{start, mid}, {mid, end}} {
+		resp, err := cf.fetch(ctx, []string{z.ZoneID}, []Dataset{d}, w[0], w[1])
+		if err != nil {
+			return nil, nil, err
 		}
-	`)
-	/*`
-		query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!) {
-			viewer {
-				zones (filter: { zoneTag_in: $zoneIDs }) {
-					zoneTag
-
-					healthCheckEventsAdaptive (limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
-						datetime
-						eventId
-						expectedResponseCodes
-						failureReason
-						fqdn
-						healthChanged
-						healthCheckId
-						healthCheckName
-						healthStatus
-						originIP
-						originResponseStatus
-						region
-						rttMs
-						sampleInterval
-						scope
-						tcpConnMs
-						timeToFirstByteMs
-						tlsHandshakeMs
-					}
-
-					httpRequests1mGroups (limit: $limit, filter: { datetime: $maxtime }) {
-						uniq {
-							uniques
-						}
-
-						sum {
-							browserMap {
-								pageViews
-								uaBrowserFamily
-							}
-
-							bytes
-							cachedBytes
-							cachedRequests
-
-							clientHTTPVersionMap {
-								clientHTTPProtocol
-								requests
-							}
-
-							clientSSLMap {
-								clientSSLProtocol
-								requests
-							}
-
-							contentTypeMap {
-								bytes
-								requests
-								edgeResponseContentTypeName
-							}
-
-							countryMap {
-								bytes
-								clientCountryName
-								requests
-								threats
-							}
-
-							encryptedBytes
-							encryptedRequests
-
-							ipClassMap {
-								ipType
-								requests
-							}
-
-							pageViews
-							requests
-
-							responseStatusMap {
-								edgeResponseStatus
-								requests
-							}
-
-							threatPathingMap {
-								requests
-								threatPathingName
-							}
-
-							threats
-						}
-
-						dimensions {
-							datetime
-						}
-					}
-
-					httpRequestsAdaptiveGroups (limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
-						count
-
-						avg {
-							sampleInterval
-						}
-
-						dimensions {
-							coloCode
-							datetime
-						}
-
-						sum {
-							edgeResponseBytes
-							visits
-						}
-					}
-
-					firewallEventsAdaptiveGroups (limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
-						count
-
-						dimensions {
-						  	action
-						  	source
-						  	clientRequestHTTPHost
-						  	clientCountryName
-						}
-					}
-
-					loadBalancingRequestsAdaptive (limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
-						coloCode
-						datetime
-						errorType
-						lbName
-						numberOriginsSelected
-
-						origins {
-							fqdn
-							health
-							ipv4
-							ipv6
-							originName
-							selected
-							weight
-						}
-
-						pools {
-							avgRttMs
-							healthCheckEnabled
-							healthy
-							id
-							poolName
-						}
-
-						region
-						sampleInterval
-						sessionAffinity
-						steeringPolicy
-					}
-				}
+		errs = append(errs, resp.Errors...)
+		for i := range resp.Viewer.Zones {
+			p := &resp.Viewer.Zones[i]
+			if p.ZoneID != z.ZoneID {
+				continue
+			}
+			t, e, err := cf.split(ctx, p, d, w[0], w[1])
+			if err != nil {
+				return nil, nil, err
 			}
+			truncated = append(truncated, t...)
+			errs = append(errs, e...)
+			z.merge(p, d)
 		}
-	`*/
-	if err := cf.Auth.Authorize(ctx, r.Header); err != nil {
-		return Response{}, errors.Wrap(err, "cloudflare: failed to authorize request")
 	}
+	return truncated, errs, nil
+}
 
-	r.Header.Set("Cache-Control", "no-cache")
+// fetch sends a single query for the datasets of every zone.
+//
+// Errors that can be attributed to a zone, using the path of the error, are
+// reported on the Response, any other error fails the entire query.
+func (cf *Cloudflare) fetch(
+	ctx context.Context,
+	zones []string,
+	datasets []Dataset,
+	start, end time.Time,
+) (Response, error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"query": buildQuery(datasets),
+		"variables": map[string]interface{}{
+			"limit":   cf.limit,
+			"maxtime": end.UTC(),
+			"mintime": start.UTC(),
+			"zoneIDs": zones,
+		},
+	})
+	if err != nil {
+		return Response{}, errors.Wrap(err, "cloudflare: failed to encode query")
+	}
 
-	now := time.Now().Add(-180 * time.Second).UTC()
-	s := 60 * time.Second
-	now = now.Truncate(s)
-	now1mAgo := now.Add(-60 * time.Second)
-	r.Var("limit", 10)
-	r.Var("maxtime", now)
-	r.Var("mintime", now1mAgo)
-	r.Var("zoneIDs", zones)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cf.url+"/graphql", bytes.NewReader(b))
+	if err != nil {
+		return Response{}, err
+	}
+	if err := cf.Auth.Authorize(ctx, req.Header); err != nil {
+		return Response{}, errors.Wrap(err, "cloudflare: failed to authorize request")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Content-Type", "application/json")
 
-	var resp Response
-	if err := cf.graphql.Run(ctx, r, &resp); err != nil {
+	res, err := cf.http.Do(req)
+	if err != nil {
 		return Response{}, errors.Wrap(err, "cloudflare: failed to get data")
 	}
+	defer res.Body.Close()
+
+	var gr struct {
+		Data   *Response  `json:"data"`
+		Errors []apiError `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&gr); err != nil {
+		if res.StatusCode >= http.StatusBadRequest {
+			return Response{}, newError(res.StatusCode, "", res.Status)
+		}
+		return Response{}, errors.Wrap(err, "cloudflare: failed to decode response")
+	}
+	if gr.Data == nil {
+		if len(gr.Errors) > 0 {
+			e := gr.Errors[0]
+			return Response{}, newError(res.StatusCode, e.code(), e.Message)
+		}
+		if res.StatusCode >= http.StatusBadRequest {
+			return Response{}, newError(res.StatusCode, "", res.Status)
+		}
+		return Response{}, errors.New("cloudflare: response did not contain any data")
+	}
+
+	resp := *gr.Data
+
+	// failed holds the errors of zones that failed entirely, these are
+	// returned as null so the path does not tell which zone failed.
+	var failed []*Error
+	for _, e := range gr.Errors {
+		err := newError(res.StatusCode, e.code(), e.Message)
+		i, dataset := errorPath(e.Path, len(resp.Viewer.Zones))
+		switch {
+		case i < 0:
+			return Response{}, err
+		case resp.Viewer.Zones[i].ZoneID == "":
+			failed = append(failed, err)
+		default:
+			err.ZoneID, err.Dataset = resp.Viewer.Zones[i].ZoneID, dataset
+			resp.Errors = append(resp.Errors, err)
+		}
+	}
+
+	// Zones that failed entirely are returned as null.
+	returned := make(map[string]struct{}, len(resp.Viewer.Zones))
+	l := resp.Viewer.Zones[:0]
+	for _, z := range resp.Viewer.Zones {
+		if z.ZoneID != "" {
+			returned[z.ZoneID] = struct{}{}
+			l = append(l, z)
+		}
+	}
+	resp.Viewer.Zones = l
+
+	// Attribute the errors of null zones to the requested zones that were not
+	// returned. Zones are returned in the order they were requested, so if
+	// there is an error for every missing zone they are matched in order,
+	// otherwise the missing zones are reported as not found by batch.
+	if len(failed) > 0 {
+		var missing []string
+		for _, z := range zones {
+			if _, ok := returned[z]; !ok {
+				missing = append(missing, z)
+			}
+		}
+		if len(missing) == 0 {
+			return Response{}, failed[0]
+		}
+		if len(missing) == len(failed) {
+			for i, z := range missing {
+				resp.Errors = append(resp.Errors, zoneError(failed[i], z))
+			}
+		}
+	}
 	return resp, nil
 }
+
+// errorPath returns the index of the zone and the dataset a GraphQL error path
+// points to, the index is -1 if the path does not point to one of the n zones.
+func errorPath(path []interface{}, n int) (int, Dataset) {
+	if len(path) < 3 || path[0] != "viewer" || path[1] != "zones" {
+		return -1, ""
+	}
+	i, ok := path[2].(float64)
+	if !ok || int(i) < 0 || int(i) >= n {
+		return -1, ""
+	}
+
+	var d Dataset
+	if len(path) > 3 {
+		if v, ok := path[3].(string); ok && Dataset(v).Valid() {
+			d = Dataset(v)
+		}
+	}
+	return int(i), d
+}
+
+// zoneError returns err as an Error that applies to the zone.
+func zoneError(err error, zone string) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		c := *e
+		c.ZoneID = zone
+		return &c
+	}
+	return &Error{Kind: ErrorUnknown, Message: err.Error(), ZoneID: zone, err: err}
+}
+
+// bytesKey is the context key of the counter the size of every response body
+// read by a request is added to.
+type bytesKey struct{}
+
+// countingTransport counts the bytes of every response body read by a request
+// whose context has a counter.
+type countingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip .
+func (t countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := r.Context().Value(bytesKey{}).(*int64); ok {
+		res.Body = &countingBody{ReadCloser: res.Body, n: n}
+	}
+	return res, nil
+}
+
+// countingBody .
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+// Read .
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,335 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package cloudflare_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare/fake"
+)
+
+var minute = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func requests(n uint64) cloudflare.Zone {
+	var z cloudflare.Zone
+	z.HTTPRequests1mGroups = []cloudflare.HTTPRequest1m{{}}
+	z.HTTPRequests1mGroups[0].Sum.Requests = n
+	return z
+}
+
+func firewall(action string) cloudflare.Zone {
+	return cloudflare.Zone{
+		FirewallEventsAdaptiveGroups: []cloudflare.FirewallEvent{{
+			Count:      1,
+			Dimensions: cloudflare.FirewallEventDimensions{Action: action},
+		}},
+	}
+}
+
+func TestQuery(t *testing.T) {
+	cf, srv := fake.NewClient(t)
+	srv.AddZone(cloudflare.ZoneInfo{ID: "a", Name: "a.example"})
+	srv.AddZone(cloudflare.ZoneInfo{ID: "b", Name: "b.example"})
+	srv.AddRows("a", minute, requests(10))
+	srv.AddRows("b", minute, requests(20))
+	srv.AddRows("a", minute.Add(time.Minute), requests(30))
+
+	r, err := cf.Query(context.Background(), cloudflare.Query{
+		Zones:    []string{"a", "b"},
+		Datasets: []cloudflare.Dataset{cloudflare.DatasetHTTPRequests1m},
+		Start:    minute,
+		End:      minute.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", r.Errors)
+	}
+
+	got := map[string]uint64{}
+	for _, z := range r.Viewer.Zones {
+		for _, row := range z.HTTPRequests1mGroups {
+			got[z.ZoneID] += row.Sum.Requests
+		}
+	}
+	if got["a"] != 10 || got["b"] != 20 {
+		t.Fatalf("expected 10 requests for a and 20 for b, got %v", got)
+	}
+	if r.Bytes == 0 {
+		t.Fatal("expected the response size to be counted")
+	}
+}
+
+func TestQuerySplitsWindowAtLimit(t *testing.T) {
+	cf, srv := fake.NewClient(t, cloudflare.WithLimit(2))
+	srv.AddZone(cloudflare.ZoneInfo{ID: "a", Name: "a.example"})
+	for i := 0; i < 4; i++ {
+		srv.AddRows("a", minute.Add(time.Duration(i)*time.Minute), requests(1))
+	}
+
+	r, err := cf.Query(context.Background(), cloudflare.Query{
+		Zones:    []string{"a"},
+		Datasets: []cloudflare.Dataset{cloudflare.DatasetHTTPRequests1m},
+		Start:    minute,
+		End:      minute.Add(4 * time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := r.Viewer.Zones[0].Rows(cloudflare.DatasetHTTPRequests1m); n != 4 {
+		t.Fatalf("expected 4 rows, got %d", n)
+	}
+	if len(r.Truncated) != 0 {
+		t.Fatalf("unexpected truncation: %v", r.Truncated)
+	}
+}
+
+func TestQueryReportsTruncation(t *testing.T) {
+	cf, srv := fake.NewClient(t, cloudflare.WithLimit(2))
+	srv.AddZone(cloudflare.ZoneInfo{ID: "a", Name: "a.example"})
+	for i := 0; i < 3; i++ {
+		srv.AddRows("a", minute, requests(1))
+	}
+
+	r, err := cf.Query(context.Background(), cloudflare.Query{
+		Zones:    []string{"a"},
+		Datasets: []cloudflare.Dataset{cloudflare.DatasetHTTPRequests1m},
+		Start:    minute,
+		End:      minute.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Truncated) != 1 || r.Truncated[0].ZoneID != "a" {
+		t.Fatalf("expected zone a to be truncated, got %v", r.Truncated)
+	}
+}
+
+func TestQueryPartialErrors(t *testing.T) {
+	cf, srv := fake.NewClient(t)
+	srv.AddZone(cloudflare.ZoneInfo{ID: "a", Name: "a.example"})
+	srv.AddRows("a", minute, requests(10))
+	srv.AddRows("a", minute, firewall("block"))
+	srv.FailDataset("a", cloudflare.DatasetFirewallEvents, "zone does not have access to the path")
+
+	r, err := cf.Query(context.Background(), cloudflare.Query{
+		Zones: []string{"a", "missing"},
+		Datasets: []cloudflare.Dataset{
+			cloudflare.DatasetFirewallEvents,
+			cloudflare.DatasetHTTPRequests1m,
+		},
+		Start: minute,
+		End:   minute.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := r.Viewer.Zones[0].Rows(cloudflare.DatasetHTTPRequests1m); n != 1 {
+		t.Fatalf("expected the rows of the working dataset, got %d", n)
+	}
+
+	kinds := map[string]cloudflare.ErrorKind{}
+	for _, e := range r.Errors {
+		kinds[e.ZoneID+"/"+string(e.Dataset)] = e.Kind
+	}
+	if k := kinds["a/"+string(cloudflare.DatasetFirewallEvents)]; k != cloudflare.ErrorPermission {
+		t.Errorf("expected a permission error for the failed dataset, got %q", k)
+	}
+	if k := kinds["missing/"]; k != cloudflare.ErrorZoneNotFound {
+		t.Errorf("expected a zone not found error for the missing zone, got %q", k)
+	}
+
+	// A zone that fails entirely is returned as null, its error must not fail
+	// the other zones.
+	srv.AddZone(cloudflare.ZoneInfo{ID: "null", Name: "null.example"})
+	srv.FailZone("null", "zone does not have access to the path")
+
+	r, err = cf.Query(context.Background(), cloudflare.Query{
+		Zones:    []string{"null", "a"},
+		Datasets: []cloudflare.Dataset{cloudflare.DatasetHTTPRequests1m},
+		Start:    minute,
+		End:      minute.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Viewer.Zones) != 1 || r.Viewer.Zones[0].Rows(cloudflare.DatasetHTTPRequests1m) != 1 {
+		t.Fatalf("expected the rows of the working zone, got %+v", r.Viewer.Zones)
+	}
+	if len(r.Errors) != 1 {
+		t.Fatalf("expected a single error, got %v", r.Errors)
+	}
+	if e := r.Errors[0]; e.ZoneID != "null" || e.Dataset != "" || e.Kind != cloudflare.ErrorPermission {
+		t.Errorf("expected the error of the null zone to be attributed to it, got %v", e)
+	}
+}
+
+func TestQueryAuthError(t *testing.T) {
+	auth, err := cloudflare.NewTokenAuthorization("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := fake.New(auth)
+	defer srv.Close()
+	srv.AddZone(cloudflare.ZoneInfo{ID: "a", Name: "a.example"})
+
+	wrong, err := cloudflare.NewTokenAuthorization("wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := cloudflare.New(wrong, cloudflare.WithURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cf.Query(context.Background(), cloudflare.Query{
+		Zones: []string{"a"},
+		Start: minute,
+		End:   minute.Add(time.Minute),
+	})
+	var e *cloudflare.Error
+	if !errors.As(err, &e) || e.Kind != cloudflare.ErrorAuth {
+		t.Fatalf("expected an auth error, got %v", err)
+	}
+}
+
+func TestQueryRetriesRateLimit(t *testing.T) {
+	cf, srv := fake.NewClient(t, cloudflare.WithRetries(2))
+	srv.AddZone(cloudflare.ZoneInfo{ID: "a", Name: "a.example"})
+	srv.AddRows("a", minute, requests(10))
+	srv.RateLimit(2, 0)
+
+	r, err := cf.Query(context.Background(), cloudflare.Query{
+		Zones:    []string{"a"},
+		Datasets: []cloudflare.Dataset{cloudflare.DatasetHTTPRequests1m},
+		Start:    minute,
+		End:      minute.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := r.Viewer.Zones[0].Rows(cloudflare.DatasetHTTPRequests1m); n != 1 {
+		t.Fatalf("expected 1 row, got %d", n)
+	}
+	if n := srv.Requests(); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+}
+
+func TestQueryGivesUpAfterRetries(t *testing.T) {
+	cf, srv := fake.NewClient(t, cloudflare.WithRetries(1))
+	srv.AddZone(cloudflare.ZoneInfo{ID: "a", Name: "a.example"})
+	srv.RateLimit(2, 0)
+
+	_, err := cf.Query(context.Background(), cloudflare.Query{
+		Zones: []string{"a"},
+		Start: minute,
+		End:   minute.Add(time.Minute),
+	})
+	var e *cloudflare.Error
+	if !errors.As(err, &e) || e.Kind != cloudflare.ErrorQuota {
+		t.Fatalf("expected a quota error, got %v", err)
+	}
+}
+
+func TestListZones(t *testing.T) {
+	cf, srv := fake.NewClient(t)
+	for i := 0; i < 120; i++ {
+		id := strconv.Itoa(i)
+		srv.AddZone(cloudflare.ZoneInfo{ID: id, Name: id + ".example"})
+	}
+
+	zones, err := cf.ListZones(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zones) != 120 {
+		t.Fatalf("expected 120 zones, got %d", len(zones))
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	cf, _ := fake.NewClient(t)
+
+	status, err := cf.VerifyToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Active() {
+		t.Fatalf("expected the token to be active, got %s", status.Status)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	cf, srv := fake.NewClient(t, cloudflare.WithRecord(dir))
+	srv.AddZone(cloudflare.ZoneInfo{ID: "a", Name: "a.example"})
+	srv.AddRows("a", minute, requests(10))
+
+	q := cloudflare.Query{
+		Zones:    []string{"a"},
+		Datasets: []cloudflare.Dataset{cloudflare.DatasetHTTPRequests1m},
+		Start:    minute,
+		End:      minute.Add(time.Minute),
+	}
+	if _, err := cf.Query(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	auth, err := cloudflare.NewTokenAuthorization("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay, err := cloudflare.New(auth, cloudflare.WithReplay(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := replay.Query(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := r.Viewer.Zones[0].HTTPRequests1mGroups[0].Sum.Requests; n != 10 {
+		t.Fatalf("expected the recorded 10 requests, got %d", n)
+	}
+
+	// A later window is answered by the recording of the same query.
+	q.Start, q.End = q.Start.Add(time.Hour), q.End.Add(time.Hour)
+	if _, err := replay.Query(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every recording of the query has been replayed.
+	q.Start, q.End = q.Start.Add(time.Hour), q.End.Add(time.Hour)
+	if _, err := replay.Query(context.Background(), q); err == nil {
+		t.Fatal("expected an error once every recording was replayed")
+	}
+}
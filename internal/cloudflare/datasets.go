@@ -0,0 +1,295 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package cloudflare
+
+import (
+	"strings"
+	"time"
+)
+
+// Dataset is a GraphQL analytics dataset that is queried for each zone.
+type Dataset string
+
+// Datasets supported by the exporter.
+const (
+	DatasetFirewallEvents        Dataset = "firewallEventsAdaptiveGroups"
+	DatasetHealthCheckEvents     Dataset = "healthCheckEventsAdaptive"
+	DatasetHTTPRequests1m        Dataset = "httpRequests1mGroups"
+	DatasetHTTPRequestsAdaptive  Dataset = "httpRequestsAdaptiveGroups"
+	DatasetLoadBalancingRequests Dataset = "loadBalancingRequestsAdaptive"
+)
+
+// Datasets is every dataset supported by the exporter.
+var Datasets = []Dataset{
+	DatasetFirewallEvents,
+	DatasetHealthCheckEvents,
+	DatasetHTTPRequests1m,
+	DatasetHTTPRequestsAdaptive,
+	DatasetLoadBalancingRequests,
+}
+
+// Valid reports whether d is a supported dataset.
+func (d Dataset) Valid() bool {
+	_, ok := datasetQueries[d]
+	return ok
+}
+
+// granularity returns the smallest window the dataset can be queried with.
+func (d Dataset) granularity() time.Duration {
+	if d == DatasetHTTPRequests1m {
+		return time.Minute
+	}
+	return time.Second
+}
+
+// datasetQueries maps every dataset to its selection in the zones query.
+var datasetQueries = map[Dataset]string{
+	DatasetFirewallEvents: `
+		firewallEventsAdaptiveGroups (limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
+			count
+
+			dimensions {
+				action
+				source
+				clientRequestHTTPHost
+				clientCountryName
+			}
+		}
+`,
+
+	DatasetHealthCheckEvents: `
+		healthCheckEventsAdaptive (limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
+			datetime
+			eventId
+			expectedResponseCodes
+			failureReason
+			fqdn
+			healthChanged
+			healthCheckId
+			healthCheckName
+			healthStatus
+			originIP
+			originResponseStatus
+			region
+			rttMs
+			sampleInterval
+			scope
+			tcpConnMs
+			timeToFirstByteMs
+			tlsHandshakeMs
+		}
+`,
+
+	DatasetHTTPRequests1m: `
+		httpRequests1mGroups (limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
+			uniq {
+				uniques
+			}
+
+			sum {
+				browserMap {
+					pageViews
+					uaBrowserFamily
+				}
+
+				bytes
+				cachedBytes
+				cachedRequests
+
+				clientHTTPVersionMap {
+					clientHTTPProtocol
+					requests
+				}
+
+				clientSSLMap {
+					clientSSLProtocol
+					requests
+				}
+
+				contentTypeMap {
+					bytes
+					requests
+					edgeResponseContentTypeName
+				}
+
+				countryMap {
+					bytes
+					clientCountryName
+					requests
+					threats
+				}
+
+				encryptedBytes
+				encryptedRequests
+
+				ipClassMap {
+					ipType
+					requests
+				}
+
+				pageViews
+				requests
+
+				responseStatusMap {
+					edgeResponseStatus
+					requests
+				}
+
+				threatPathingMap {
+					requests
+					threatPathingName
+				}
+
+				threats
+			}
+
+			dimensions {
+				datetime
+			}
+		}
+`,
+
+	DatasetHTTPRequestsAdaptive: `
+		httpRequestsAdaptiveGroups (limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
+			count
+
+			avg {
+				sampleInterval
+			}
+
+			dimensions {
+				coloCode
+				datetime
+			}
+
+			sum {
+				edgeResponseBytes
+				visits
+			}
+		}
+`,
+
+	DatasetLoadBalancingRequests: `
+		loadBalancingRequestsAdaptive (limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
+			coloCode
+			datetime
+			errorType
+			lbName
+			numberOriginsSelected
+
+			origins {
+				fqdn
+				health
+				ipv4
+				ipv6
+				originName
+				selected
+				weight
+			}
+
+			pools {
+				avgRttMs
+				healthCheckEnabled
+				healthy
+				id
+				poolName
+			}
+
+			region
+			sampleInterval
+			selectedOriginName
+			selectedPoolName
+			sessionAffinity
+			steeringPolicy
+		}
+`,
+}
+
+// buildQuery builds a query selecting the given datasets for every zone.
+func buildQuery(datasets []Dataset) string {
+	var b strings.Builder
+	b.WriteString(`
+query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!) {
+	viewer {
+		zones (filter: { zoneTag_in: $zoneIDs }) {
+			zoneTag
+`)
+	for _, d := range datasets {
+		b.WriteString(datasetQueries[d])
+	}
+	b.WriteString(`
+		}
+	}
+}
+`)
+	return b.String()
+}
+
+// Rows returns the number of rows the zone has for the dataset.
+func (z *Zone) Rows(d Dataset) int {
+	switch d {
+	case DatasetFirewallEvents:
+		return len(z.FirewallEventsAdaptiveGroups)
+	case DatasetHealthCheckEvents:
+		return len(z.HealthCheckEventsAdaptive)
+	case DatasetHTTPRequests1m:
+		return len(z.HTTPRequests1mGroups)
+	case DatasetHTTPRequestsAdaptive:
+		return len(z.HTTPRequestsAdaptiveGroups)
+	case DatasetLoadBalancingRequests:
+		return len(z.LoadBalancingRequestsAdaptive)
+	}
+	return 0
+}
+
+// Clear removes every row the zone has for the dataset.
+func (z *Zone) Clear(d Dataset) {
+	switch d {
+	case DatasetFirewallEvents:
+		z.FirewallEventsAdaptiveGroups = nil
+	case DatasetHealthCheckEvents:
+		z.HealthCheckEventsAdaptive = nil
+	case DatasetHTTPRequests1m:
+		z.HTTPRequests1mGroups = nil
+	case DatasetHTTPRequestsAdaptive:
+		z.HTTPRequestsAdaptiveGroups = nil
+	case DatasetLoadBalancingRequests:
+		z.LoadBalancingRequestsAdaptive = nil
+	}
+}
+
+// merge appends the rows o has for the dataset to z.
+func (z *Zone) merge(o *Zone, d Dataset) {
+	switch d {
+	case DatasetFirewallEvents:
+		z.FirewallEventsAdaptiveGroups = append(z.FirewallEventsAdaptiveGroups, o.FirewallEventsAdaptiveGroups...)
+	case DatasetHealthCheckEvents:
+		z.HealthCheckEventsAdaptive = append(z.HealthCheckEventsAdaptive, o.HealthCheckEventsAdaptive...)
+	case DatasetHTTPRequests1m:
+		z.HTTPRequests1mGroups = append(z.HTTPRequests1mGroups, o.HTTPRequests1mGroups...)
+	case DatasetHTTPRequestsAdaptive:
+		z.HTTPRequestsAdaptiveGroups = append(z.HTTPRequestsAdaptiveGroups, o.HTTPRequestsAdaptiveGroups...)
+	case DatasetLoadBalancingRequests:
+		z.LoadBalancingRequestsAdaptive = append(z.LoadBalancingRequestsAdaptive, o.LoadBalancingRequestsAdaptive...)
+	}
+}
@@ -0,0 +1,202 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package cloudflare
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorKind .
+type ErrorKind string
+
+// Kinds of errors returned by the Cloudflare API.
+const (
+	// ErrorAuth is returned when the credentials are invalid.
+	ErrorAuth ErrorKind = "auth"
+
+	// ErrorPermission is returned when the credentials are not allowed to
+	// read a dataset.
+	ErrorPermission ErrorKind = "permission"
+
+	// ErrorZoneNotFound is returned when a zone does not exist or is not
+	// visible to the credentials.
+	ErrorZoneNotFound ErrorKind = "zone_not_found"
+
+	// ErrorQuota is returned when too many requests have been made.
+	ErrorQuota ErrorKind = "quota"
+
+	// ErrorQueryCost is returned when a query is too expensive to run.
+	ErrorQueryCost ErrorKind = "query_cost"
+
+	// ErrorTimeRange is returned when the queried window is not allowed for
+	// the zone's plan.
+	ErrorTimeRange ErrorKind = "time_range"
+
+	// ErrorUnknown is returned for any other error.
+	ErrorUnknown ErrorKind = "unknown"
+)
+
+// Error is an error returned by the Cloudflare API.
+type Error struct {
+	// Kind .
+	Kind ErrorKind
+
+	// Code is the error code returned by Cloudflare, if any.
+	Code string
+
+	// Message .
+	Message string
+
+	// Status is the HTTP status code of the response.
+	Status int
+
+	// ZoneID is the zone the error applies to, if empty the error applies to
+	// every zone in the query.
+	ZoneID string
+
+	// Dataset is the dataset the error applies to, if empty the error applies
+	// to every dataset in the query.
+	Dataset Dataset
+
+	// err is the underlying error, if the error was not returned by the API.
+	err error
+}
+
+var _ error = (*Error)(nil)
+
+// Error .
+func (e *Error) Error() string {
+	s := "cloudflare: " + string(e.Kind)
+	if e.ZoneID != "" {
+		s += " (zone " + e.ZoneID
+		if e.Dataset != "" {
+			s += ", " + string(e.Dataset)
+		}
+		s += ")"
+	}
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+// Unwrap .
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Skippable reports whether the error is caused by the zone's plan or the
+// permissions of the credentials, so querying the dataset again will keep
+// failing.
+func (e *Error) Skippable() bool {
+	switch e.Kind {
+	case ErrorPermission, ErrorTimeRange, ErrorZoneNotFound:
+		return true
+	}
+	return false
+}
+
+// newError returns an Error with its kind inferred from the HTTP status code,
+// error code and message returned by Cloudflare.
+func newError(status int, code, message string) *Error {
+	return &Error{
+		Kind:    classify(status, code, message),
+		Code:    code,
+		Message: message,
+		Status:  status,
+	}
+}
+
+// classify infers the kind of an error. Cloudflare does not consistently
+// return error codes from the GraphQL API, so the message is matched as well.
+func classify(status int, code, message string) ErrorKind {
+	m := strings.ToLower(message)
+	switch {
+	case status == http.StatusTooManyRequests,
+		strings.Contains(m, "rate limit"),
+		strings.Contains(m, "limit reached"),
+		strings.Contains(m, "quota"),
+		strings.Contains(m, "budget depleted"):
+		return ErrorQuota
+
+	case strings.Contains(m, "cost"),
+		strings.Contains(m, "complexity"):
+		return ErrorQueryCost
+
+	case strings.Contains(m, "does not have access"),
+		strings.Contains(m, "access denied"),
+		strings.Contains(m, "permission"),
+		code == "authz":
+		return ErrorPermission
+
+	case code == "7003",
+		code == "1001",
+		strings.Contains(m, "zone") && strings.Contains(m, "not found"),
+		strings.Contains(m, "could not route"):
+		return ErrorZoneNotFound
+
+	// Only match the limits of the zone's plan, any other error about the
+	// window, such as an invalid filter, is a bug that must be reported.
+	case strings.Contains(m, "cannot request data older than"),
+		strings.Contains(m, "time range is too large"),
+		strings.Contains(m, "time range can't be wider than"):
+		return ErrorTimeRange
+
+	case status == http.StatusUnauthorized,
+		status == http.StatusForbidden,
+		code == "10000",
+		code == "9109",
+		strings.Contains(m, "authentication"),
+		strings.Contains(m, "not authorized"),
+		strings.Contains(m, "unauthorized"),
+		strings.Contains(m, "invalid api token"),
+		strings.Contains(m, "invalid access token"):
+		return ErrorAuth
+	}
+	return ErrorUnknown
+}
+
+// apiError is an error as returned by both the GraphQL and REST APIs.
+type apiError struct {
+	Message string        `json:"message"`
+	Code    interface{}   `json:"code"`
+	Path    []interface{} `json:"path"`
+
+	Extensions struct {
+		Code string `json:"code"`
+	} `json:"extensions"`
+}
+
+// code returns the error code, which is a number for the REST API and a string
+// for the GraphQL API.
+func (e apiError) code() string {
+	switch v := e.Code.(type) {
+	case float64:
+		return strconv.Itoa(int(v))
+	case string:
+		return v
+	}
+	return e.Extensions.Code
+}
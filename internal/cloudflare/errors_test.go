@@ -0,0 +1,43 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package cloudflare
+
+import "testing"
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		message string
+		want    ErrorKind
+	}{
+		{"cannot request data older than 2678400s", ErrorTimeRange},
+		{"query time range is too large. Time range can't be wider than 86400s, but it's 172800s", ErrorTimeRange},
+		{"zone '023e105f4ecef8ad9ca31a8372d0c353' does not have access to the path", ErrorPermission},
+		{"error parsing args for \"httpRequests1mGroups\": filter: datetime_geq: invalid value", ErrorUnknown},
+		{"unknown field \"datetime_gt\"", ErrorUnknown},
+	}
+	for _, tt := range tests {
+		if got := classify(200, "", tt.message); got != tt.want {
+			t.Errorf("classify(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
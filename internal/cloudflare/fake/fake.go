@@ -0,0 +1,408 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+// Package fake implements a fake Cloudflare API for tests and offline
+// development.
+//
+// The fake speaks enough of the GraphQL analytics API to answer the queries
+// sent by the cloudflare package, along with the zone listing and token
+// verification endpoints of the REST API. Requests must carry the headers set
+// by the Auth the server was created with. Errors and rate limits can be
+// injected to exercise error handling.
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+)
+
+// Server is a fake Cloudflare API.
+type Server struct {
+	// URL is the base URL of the API, for use with cloudflare.WithURL.
+	URL string
+
+	srv     *httptest.Server
+	headers http.Header
+
+	mu       sync.Mutex
+	zones    []cloudflare.ZoneInfo
+	rows     map[string][]bucket
+	errors   map[string]map[cloudflare.Dataset]string
+	nulls    map[string]string
+	failures []failure
+	requests int
+	status   string
+}
+
+// bucket holds the rows of a zone for a single point in time.
+type bucket struct {
+	t    time.Time
+	rows cloudflare.Zone
+}
+
+// failure is an injected failure of a whole request.
+type failure struct {
+	status     int
+	message    string
+	retryAfter time.Duration
+}
+
+// New starts a fake API that only accepts requests authorized by auth.
+func New(auth cloudflare.Auth) *Server {
+	h := http.Header{}
+	if err := auth.Authorize(context.Background(), h); err != nil {
+		panic("fake: failed to authorize: " + err.Error())
+	}
+
+	s := &Server{
+		headers: h,
+		rows:    map[string][]bucket{},
+		errors:  map[string]map[cloudflare.Dataset]string{},
+		nulls:   map[string]string{},
+		status:  "active",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graphql", s.graphql)
+	mux.HandleFunc("/zones", s.listZones)
+	mux.HandleFunc("/user/tokens/verify", s.verifyToken)
+	s.srv = httptest.NewServer(s.handle(mux))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Requests returns the number of requests received, including failed ones.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// AddZone adds a zone that is listed and can be queried.
+func (s *Server) AddZone(z cloudflare.ZoneInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones = append(s.zones, z)
+}
+
+// AddRows adds rows to the zone at t, they are returned by any query whose
+// window includes t.
+func (s *Server) AddRows(zoneID string, t time.Time, rows cloudflare.Zone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rows[zoneID] = append(s.rows[zoneID], bucket{t: t, rows: rows})
+}
+
+// FailDataset makes every query of the dataset for the zone return an error
+// with the message, while other zones and datasets keep working.
+func (s *Server) FailDataset(zoneID string, d cloudflare.Dataset, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.errors[zoneID] == nil {
+		s.errors[zoneID] = map[cloudflare.Dataset]string{}
+	}
+	s.errors[zoneID][d] = message
+}
+
+// FailZone makes every query of the zone return it as null along with an error
+// with the message, while other zones keep working.
+func (s *Server) FailZone(zoneID, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nulls[zoneID] = message
+}
+
+// SetTokenStatus sets the status the token is reported with when verified.
+func (s *Server) SetTokenStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Fail makes the next n requests fail with the status code and message.
+func (s *Server) Fail(n, status int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, failure{status: status, message: message})
+	}
+}
+
+// RateLimit makes the next n requests fail with 429 Too Many Requests and a
+// Retry-After header.
+func (s *Server) RateLimit(n int, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, failure{
+			status:     http.StatusTooManyRequests,
+			message:    "rate limited, please wait and consider throttling your request speed",
+			retryAfter: retryAfter,
+		})
+	}
+}
+
+// handle counts requests, checks that they are authorized and returns any
+// injected failure before passing them on to next.
+func (s *Server) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		var f *failure
+		if len(s.failures) > 0 {
+			f = &s.failures[0]
+			s.failures = s.failures[1:]
+		}
+		s.mu.Unlock()
+
+		if f != nil {
+			if f.status == http.StatusTooManyRequests {
+				secs := int((f.retryAfter + time.Second - 1) / time.Second)
+				w.Header().Set("Retry-After", strconv.Itoa(secs))
+			}
+			writeError(w, f.status, 0, f.message)
+			return
+		}
+
+		for k := range s.headers {
+			if r.Header.Get(k) != s.headers.Get(k) {
+				writeError(w, http.StatusForbidden, 10000, "Authentication error")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeError writes an error in the envelope shared by the GraphQL and REST
+// APIs.
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	e := map[string]interface{}{"message": message}
+	if code != 0 {
+		e["code"] = code
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"success": false,
+		"data":    nil,
+		"errors":  []interface{}{e},
+	})
+}
+
+// writeJSON .
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// graphql answers an analytics query.
+func (s *Server) graphql(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, 0, "method not allowed")
+		return
+	}
+
+	var req struct {
+		Query     string `json:"query"`
+		Variables struct {
+			Limit   int       `json:"limit"`
+			MinTime time.Time `json:"mintime"`
+			MaxTime time.Time `json:"maxtime"`
+			ZoneIDs []string  `json:"zoneIDs"`
+		} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, 0, "failed to parse request: "+err.Error())
+		return
+	}
+	v := req.Variables
+
+	var datasets []cloudflare.Dataset
+	for _, d := range cloudflare.Datasets {
+		if strings.Contains(req.Query, string(d)+" (") {
+			datasets = append(datasets, d)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	known := make(map[string]struct{}, len(s.zones))
+	for _, z := range s.zones {
+		known[z.ID] = struct{}{}
+	}
+
+	zones := []interface{}{}
+	errs := []interface{}{}
+	for _, id := range v.ZoneIDs {
+		if _, ok := known[id]; !ok {
+			continue
+		}
+		if msg, ok := s.nulls[id]; ok {
+			errs = append(errs, map[string]interface{}{
+				"message": msg,
+				"path":    []interface{}{"viewer", "zones", len(zones)},
+			})
+			zones = append(zones, nil)
+			continue
+		}
+
+		z := cloudflare.Zone{ZoneID: id}
+		for _, b := range s.rows[id] {
+			if b.t.Before(v.MinTime) || !b.t.Before(v.MaxTime) {
+				continue
+			}
+			for _, d := range datasets {
+				appendRows(&z, b.rows, d)
+			}
+		}
+
+		// Encode the zone as a map, so only the queried datasets are included.
+		b, _ := json.Marshal(z)
+		var m map[string]interface{}
+		_ = json.Unmarshal(b, &m)
+		out := map[string]interface{}{"zoneTag": id}
+		for _, d := range datasets {
+			if msg, ok := s.errors[id][d]; ok {
+				out[string(d)] = nil
+				errs = append(errs, map[string]interface{}{
+					"message": msg,
+					"path":    []interface{}{"viewer", "zones", len(zones), string(d)},
+				})
+				continue
+			}
+			rows, _ := m[string(d)].([]interface{})
+			if rows == nil {
+				rows = []interface{}{}
+			}
+			if v.Limit > 0 && len(rows) > v.Limit {
+				rows = rows[:v.Limit]
+			}
+			out[string(d)] = rows
+		}
+		zones = append(zones, out)
+	}
+
+	res := map[string]interface{}{
+		"data": map[string]interface{}{
+			"viewer": map[string]interface{}{"zones": zones},
+		},
+		"errors": nil,
+	}
+	if len(errs) > 0 {
+		res["errors"] = errs
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// appendRows appends the rows src has for the dataset to dst.
+func appendRows(dst *cloudflare.Zone, src cloudflare.Zone, d cloudflare.Dataset) {
+	switch d {
+	case cloudflare.DatasetFirewallEvents:
+		dst.FirewallEventsAdaptiveGroups = append(
+			dst.FirewallEventsAdaptiveGroups,
+			src.FirewallEventsAdaptiveGroups...,
+		)
+	case cloudflare.DatasetHealthCheckEvents:
+		dst.HealthCheckEventsAdaptive = append(
+			dst.HealthCheckEventsAdaptive,
+			src.HealthCheckEventsAdaptive...,
+		)
+	case cloudflare.DatasetHTTPRequests1m:
+		dst.HTTPRequests1mGroups = append(dst.HTTPRequests1mGroups, src.HTTPRequests1mGroups...)
+	case cloudflare.DatasetHTTPRequestsAdaptive:
+		dst.HTTPRequestsAdaptiveGroups = append(
+			dst.HTTPRequestsAdaptiveGroups,
+			src.HTTPRequestsAdaptiveGroups...,
+		)
+	case cloudflare.DatasetLoadBalancingRequests:
+		dst.LoadBalancingRequestsAdaptive = append(
+			dst.LoadBalancingRequestsAdaptive,
+			src.LoadBalancingRequestsAdaptive...,
+		)
+	}
+}
+
+// listZones lists the zones a page at a time.
+func (s *Server) listZones(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = 20
+	}
+
+	s.mu.Lock()
+	zones := append([]cloudflare.ZoneInfo(nil), s.zones...)
+	s.mu.Unlock()
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Name < zones[j].Name })
+
+	total := (len(zones) + perPage - 1) / perPage
+	start := (page - 1) * perPage
+	if start > len(zones) {
+		start = len(zones)
+	}
+	end := start + perPage
+	if end > len(zones) {
+		end = len(zones)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"errors":  []interface{}{},
+		"result":  zones[start:end],
+		"result_info": map[string]interface{}{
+			"page":        page,
+			"total_pages": total,
+		},
+	})
+}
+
+// verifyToken reports the status of the token, active unless changed by
+// SetTokenStatus. Requests with any other token are rejected before reaching
+// it.
+func (s *Server) verifyToken(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	status := s.status
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"errors":  []interface{}{},
+		"result":  map[string]interface{}{"id": "fake", "status": status},
+	})
+}
@@ -0,0 +1,74 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package fake
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/collector"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+)
+
+// Token is the API token accepted by a server started by NewClient.
+const Token = "token"
+
+// NewClient starts a fake API that is closed when the test finishes and
+// returns a client authorized to query it.
+func NewClient(t testing.TB, opts ...cloudflare.Option) (*cloudflare.Cloudflare, *Server) {
+	t.Helper()
+
+	auth, err := cloudflare.NewTokenAuthorization(Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(auth)
+	t.Cleanup(srv.Close)
+
+	cf, err := cloudflare.New(auth, append([]cloudflare.Option{cloudflare.WithURL(srv.URL)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cf, srv
+}
+
+// NewCollector returns a collector for the zones. Series are global, so the
+// series of the zones left by an earlier run of the test are removed first.
+func NewCollector(lag, lookback time.Duration, zones ...collector.Zone) *collector.Collector {
+	for _, z := range zones {
+		metrics.Unregister(metrics.NewZone(z.Account, z.Name, z.Labels))
+	}
+	return collector.New(lag, lookback)
+}
+
+// End returns the end of the window queried by the first collection with the
+// lag, rows added at the minute before it are collected. If the current minute
+// is about to end it waits for the next one, so the window does not change
+// before the test collects it.
+func End(lag time.Duration) time.Time {
+	if d := time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)); d < 2*time.Second {
+		time.Sleep(d)
+	}
+	return time.Now().Add(-lag).UTC().Truncate(time.Minute)
+}
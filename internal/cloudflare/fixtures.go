@@ -0,0 +1,323 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package cloudflare
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Fixture is a request made to the API and the response it returned, as
+// written by WithRecord and served by WithReplay.
+//
+// Credentials are sent as headers and are never part of a fixture.
+type Fixture struct {
+	// Method .
+	Method string `json:"method"`
+
+	// Endpoint is the path and query of the request relative to the base URL,
+	// such as /graphql.
+	Endpoint string `json:"endpoint"`
+
+	// Request is the body of the request, if any.
+	Request json.RawMessage `json:"request,omitempty"`
+
+	// Status is the HTTP status code of the response.
+	Status int `json:"status"`
+
+	// Response is the body of the response if it is valid JSON, otherwise
+	// Text is.
+	Response json.RawMessage `json:"response,omitempty"`
+	Text     string          `json:"text,omitempty"`
+}
+
+// key returns the key matching requests to the fixture. If loose is set the
+// window of GraphQL queries is ignored, so a recording can be replayed at a
+// later time.
+func (f *Fixture) key(loose bool) string {
+	body := f.Request
+	var v map[string]interface{}
+	if len(body) > 0 && json.Unmarshal(body, &v) == nil {
+		if vars, ok := v["variables"].(map[string]interface{}); ok && loose {
+			delete(vars, "mintime")
+			delete(vars, "maxtime")
+		}
+		// Encoding the body again sorts its keys and removes whitespace.
+		if b, err := json.Marshal(v); err == nil {
+			body = b
+		}
+	}
+	return f.Method + " " + f.Endpoint + " " + string(body)
+}
+
+// body returns the body of the response.
+func (f *Fixture) body() []byte {
+	if len(f.Response) > 0 {
+		return f.Response
+	}
+	return []byte(f.Text)
+}
+
+// WithRecord writes every request made by the client and the response it
+// returned as a fixture to dir, which is created if missing. Responses are
+// recorded after any retries, so only the final response of a request is kept.
+func WithRecord(dir string) Option {
+	return func(cf *Cloudflare) {
+		cf.record = dir
+	}
+}
+
+// WithReplay serves requests from the fixtures in dir instead of the API.
+//
+// A request is answered by the fixture recorded for the exact same request.
+// Otherwise GraphQL queries are answered by the fixtures recorded for the same
+// query regardless of its window, in the order they were recorded, so the
+// exporter can be run against a recording. Requests without a fixture fail.
+func WithReplay(dir string) Option {
+	return func(cf *Cloudflare) {
+		cf.replay = dir
+	}
+}
+
+// endpoint returns the path and query of r relative to the base path.
+func endpoint(r *http.Request, base string) string {
+	return strings.TrimPrefix(r.URL.RequestURI(), base)
+}
+
+// recordTransport writes every request and its response to a directory.
+type recordTransport struct {
+	next http.RoundTripper
+	dir  string
+	base string
+
+	mu *sync.Mutex
+	n  *int
+}
+
+// newRecordTransport returns a recordTransport writing to dir, numbering the
+// fixtures after any already in the directory.
+func newRecordTransport(next http.RoundTripper, dir, base string) (recordTransport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return recordTransport{}, errors.Wrap(err, "cloudflare: failed to create fixture directory")
+	}
+	names, err := fixtureNames(dir)
+	if err != nil {
+		return recordTransport{}, err
+	}
+	n := len(names)
+	return recordTransport{next: next, dir: dir, base: base, mu: &sync.Mutex{}, n: &n}, nil
+}
+
+// RoundTrip .
+func (t recordTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	f := &Fixture{Method: r.Method, Endpoint: endpoint(r, t.base)}
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if json.Valid(b) {
+			f.Request = json.RawMessage(b)
+		}
+	}
+
+	res, err := t.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(b))
+
+	f.Status = res.StatusCode
+	if json.Valid(b) {
+		f.Response = json.RawMessage(b)
+	} else {
+		f.Text = string(b)
+	}
+	if err := t.write(f); err != nil {
+		fmt.Printf("failed to record response: %v\n", err)
+	}
+	return res, nil
+}
+
+// write writes the fixture to the next file in the directory.
+func (t recordTransport) write(f *Fixture) error {
+	b, err := json.MarshalIndent(f, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256([]byte(f.key(false)))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Clients of other accounts may record to the same directory, so skip
+	// over any number that is already taken.
+	for {
+		*t.n++
+		name := fmt.Sprintf("%06d-%s.json", *t.n, hex.EncodeToString(sum[:4]))
+		file, err := os.OpenFile(filepath.Join(t.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(append(b, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+}
+
+// replayTransport answers requests with recorded fixtures.
+type replayTransport struct {
+	base string
+
+	mu    sync.Mutex
+	exact map[string]*Fixture
+	loose map[string][]*Fixture
+}
+
+// newReplayTransport returns a replayTransport serving the fixtures in dir.
+func newReplayTransport(dir, base string) (*replayTransport, error) {
+	names, err := fixtureNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, errors.Errorf("cloudflare: no fixtures found in %s", dir)
+	}
+
+	t := &replayTransport{
+		base:  base,
+		exact: map[string]*Fixture{},
+		loose: map[string][]*Fixture{},
+	}
+	for _, name := range names {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, errors.Wrap(err, "cloudflare: failed to read fixture")
+		}
+		f := &Fixture{}
+		if err := json.Unmarshal(b, f); err != nil {
+			return nil, errors.Wrapf(err, "cloudflare: failed to decode fixture %s", name)
+		}
+		if _, ok := t.exact[f.key(false)]; !ok {
+			t.exact[f.key(false)] = f
+		}
+		k := f.key(true)
+		t.loose[k] = append(t.loose[k], f)
+	}
+	return t, nil
+}
+
+// RoundTrip .
+func (t *replayTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	req := &Fixture{Method: r.Method, Endpoint: endpoint(r, t.base)}
+	if r.Body != nil {
+		b, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if json.Valid(b) {
+			req.Request = json.RawMessage(b)
+		}
+	}
+
+	f := t.match(req)
+	if f == nil {
+		f = &Fixture{
+			Status:   http.StatusNotFound,
+			Response: json.RawMessage(`{"errors":[{"message":"no recorded response for request"}]}`),
+		}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+		StatusCode:    f.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(f.body())),
+		ContentLength: int64(len(f.body())),
+		Request:       r,
+	}, nil
+}
+
+// match returns the fixture answering req, or nil if there is none.
+func (t *replayTransport) match(req *Fixture) *Fixture {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if f, ok := t.exact[req.key(false)]; ok {
+		return f
+	}
+	k := req.key(true)
+	l := t.loose[k]
+	if len(l) == 0 {
+		return nil
+	}
+	t.loose[k] = l[1:]
+	return l[0]
+}
+
+// fixtureNames returns the names of the fixtures in dir in the order they were
+// recorded.
+func fixtureNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cloudflare: failed to read fixture directory")
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -30,6 +30,24 @@ import (
 type Response struct {
 	// Viewer .
 	Viewer ResponseViewer `json:"viewer"`
+
+	// Truncated lists every zone and dataset that returned more rows than the
+	// limit allows, even after paging.
+	Truncated []Truncation `json:"-"`
+
+	// Errors lists every error that only affected some zones or datasets.
+	Errors []*Error `json:"-"`
+
+	// Bytes is the total size of every response body read for the query.
+	Bytes int64 `json:"-"`
+}
+
+// Truncation .
+type Truncation struct {
+	ZoneID  string
+	Dataset Dataset
+	Start   time.Time
+	End     time.Time
 }
 
 // ResponseViewer .
@@ -70,6 +88,7 @@ type FirewallEventDimensions struct {
 	Action                string `json:"action"`
 	ClientCountryName     string `json:"clientCountryName"`
 	ClientRequestHTTPHost string `json:"clientRequestHTTPHost"`
+	Source                string `json:"source"`
 }
 
 // HealthCheckEvent .
@@ -194,6 +213,8 @@ type LoadBalancingRequest struct {
 	Pools                 []Pool    `json:"pools"`
 	Region                string    `json:"region"`
 	SampleInterval        uint32    `json:"sampleInterval"`
+	SelectedOriginName    string    `json:"selectedOriginName"`
+	SelectedPoolName      string    `json:"selectedPoolName"`
 	SessionAffinity       string    `json:"sessionAffinity"`
 	SteeringPolicy        string    `json:"steeringPolicy"`
 }
@@ -0,0 +1,222 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Secret is a source of a secret, such as an API token.
+type Secret interface {
+	// Get returns the current value of the secret.
+	Get(context.Context) (string, error)
+}
+
+// StaticSecret is a secret that never changes.
+type StaticSecret string
+
+var _ Secret = StaticSecret("")
+
+// Get .
+func (s StaticSecret) Get(context.Context) (string, error) {
+	return string(s), nil
+}
+
+// EnvSecret reads a secret from the environment variable it names.
+type EnvSecret string
+
+var _ Secret = EnvSecret("")
+
+// Get .
+func (s EnvSecret) Get(context.Context) (string, error) {
+	v, ok := os.LookupEnv(string(s))
+	if !ok {
+		return "", errors.Errorf("cloudflare: environment variable %s is not set", string(s))
+	}
+	return strings.TrimSpace(v), nil
+}
+
+// FileSecret reads a secret from a file, surrounding whitespace is trimmed.
+//
+// The file is read again whenever its modification time or size changes, so a
+// rotated secret, such as a Kubernetes secret or one written by a Vault agent,
+// is picked up without a restart.
+type FileSecret struct {
+	path string
+
+	mu      sync.Mutex
+	value   string
+	modTime time.Time
+	size    int64
+}
+
+var _ Secret = (*FileSecret)(nil)
+
+// NewFileSecret .
+func NewFileSecret(path string) *FileSecret {
+	return &FileSecret{path: path}
+}
+
+// Get .
+func (s *FileSecret) Get(context.Context) (string, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return "", errors.Wrap(err, "cloudflare: failed to read secret")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.value != "" && fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return s.value, nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", errors.Wrap(err, "cloudflare: failed to read secret")
+	}
+	s.value = strings.TrimSpace(string(b))
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	return s.value, nil
+}
+
+// ExecSecret reads a secret from the standard output of a command, surrounding
+// whitespace is trimmed.
+//
+// The output is reused until the refresh interval has passed, after which the
+// command is run again.
+type ExecSecret struct {
+	command []string
+	refresh time.Duration
+
+	mu      sync.Mutex
+	value   string
+	expires time.Time
+}
+
+var _ Secret = (*ExecSecret)(nil)
+
+// NewExecSecret .
+func NewExecSecret(command []string, refresh time.Duration) (*ExecSecret, error) {
+	if len(command) == 0 {
+		return nil, errors.New("cloudflare: missing command")
+	}
+	return &ExecSecret{command: command, refresh: refresh}, nil
+}
+
+// Get .
+func (s *ExecSecret) Get(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.value != "" && time.Now().Before(s.expires) {
+		return s.value, nil
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.Wrapf(err, "cloudflare: failed to run secret command (%s)", msg)
+		}
+		return "", errors.Wrap(err, "cloudflare: failed to run secret command")
+	}
+	s.value = strings.TrimSpace(string(out))
+	s.expires = time.Now().Add(s.refresh)
+	return s.value, nil
+}
+
+// SecretAuthorization reads its credentials from secrets on every request, so
+// rotated credentials are used as soon as the secret changes.
+type SecretAuthorization struct {
+	// Token is used if set, otherwise Email and Key are used.
+	Token Secret
+	Email Secret
+	Key   Secret
+}
+
+var _ Auth = (*SecretAuthorization)(nil)
+
+// NewSecretTokenAuthorization .
+func NewSecretTokenAuthorization(token Secret) (*SecretAuthorization, error) {
+	if token == nil {
+		return nil, errors.New("cloudflare: missing token")
+	}
+	return &SecretAuthorization{Token: token}, nil
+}
+
+// NewSecretKeyAuthorization .
+func NewSecretKeyAuthorization(email, key Secret) (*SecretAuthorization, error) {
+	if email == nil {
+		return nil, errors.New("cloudflare: missing email")
+	}
+	if key == nil {
+		return nil, errors.New("cloudflare: missing key")
+	}
+	return &SecretAuthorization{Email: email, Key: key}, nil
+}
+
+// Authorize .
+func (a *SecretAuthorization) Authorize(ctx context.Context, h http.Header) error {
+	if a.Token != nil {
+		token, err := get(ctx, a.Token, "token")
+		if err != nil {
+			return err
+		}
+		h.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+
+	email, err := get(ctx, a.Email, "email")
+	if err != nil {
+		return err
+	}
+	key, err := get(ctx, a.Key, "key")
+	if err != nil {
+		return err
+	}
+	h.Set("X-Auth-Email", email)
+	h.Set("X-Auth-Key", key)
+	return nil
+}
+
+// get returns the value of the secret, failing if it is empty.
+func get(ctx context.Context, s Secret, name string) (string, error) {
+	v, err := s.Get(ctx)
+	if err != nil {
+		return "", err
+	}
+	if v == "" {
+		return "", errors.New("cloudflare: missing " + name)
+	}
+	return v, nil
+}
@@ -0,0 +1,61 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TokenStatus is the result of verifying an API token.
+type TokenStatus struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	NotBefore *time.Time `json:"not_before"`
+	ExpiresOn *time.Time `json:"expires_on"`
+}
+
+// Active reports whether the token can be used.
+func (s TokenStatus) Active() bool {
+	return s.Status == "active"
+}
+
+// VerifyToken verifies the API token used by the client, only clients using an
+// API token can be verified.
+func (cf *Cloudflare) VerifyToken(ctx context.Context) (TokenStatus, error) {
+	var (
+		res    restResponse
+		status TokenStatus
+	)
+	if err := cf.rest(ctx, http.MethodGet, "/user/tokens/verify", &res); err != nil {
+		return TokenStatus{}, errors.Wrap(err, "cloudflare: failed to verify token")
+	}
+	if err := json.Unmarshal(res.Result, &status); err != nil {
+		return TokenStatus{}, errors.Wrap(err, "cloudflare: failed to decode token status")
+	}
+	return status, nil
+}
@@ -0,0 +1,213 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// zonesPerPage is the number of zones requested per page when listing zones.
+const zonesPerPage = 50
+
+// ZoneInfo .
+type ZoneInfo struct {
+	// ID .
+	ID string `json:"id"`
+
+	// Name .
+	Name string `json:"name"`
+
+	// Status .
+	Status string `json:"status"`
+
+	// Account .
+	Account ZoneAccount `json:"account"`
+
+	// Plan .
+	Plan ZonePlan `json:"plan"`
+}
+
+// ZoneAccount .
+type ZoneAccount struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ZonePlan .
+type ZonePlan struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	LegacyID string `json:"legacy_id"`
+}
+
+// restResponse is the envelope returned by every Cloudflare REST endpoint.
+type restResponse struct {
+	Success    bool            `json:"success"`
+	Errors     []apiError      `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+// err returns an error describing why the request was not successful.
+func (r *restResponse) err(status int) error {
+	if r.Success {
+		return nil
+	}
+	if len(r.Errors) == 0 {
+		return newError(status, "", "request was not successful")
+	}
+	msgs := make([]string, len(r.Errors))
+	for i, e := range r.Errors {
+		msgs[i] = e.code() + ": " + e.Message
+	}
+	return newError(status, r.Errors[0].code(), strings.Join(msgs, ", "))
+}
+
+// ListZones returns every active zone visible to the configured Auth.
+func (cf *Cloudflare) ListZones(ctx context.Context) ([]ZoneInfo, error) {
+	var zones []ZoneInfo
+	for page := 1; ; page++ {
+		q := url.Values{}
+		q.Set("status", "active")
+		q.Set("page", strconv.Itoa(page))
+		q.Set("per_page", strconv.Itoa(zonesPerPage))
+
+		var (
+			res    restResponse
+			result []ZoneInfo
+		)
+		if err := cf.rest(ctx, http.MethodGet, "/zones?"+q.Encode(), &res); err != nil {
+			return nil, errors.Wrap(err, "cloudflare: failed to list zones")
+		}
+		if err := json.Unmarshal(res.Result, &result); err != nil {
+			return nil, errors.Wrap(err, "cloudflare: failed to decode zones")
+		}
+		zones = append(zones, result...)
+
+		if len(result) == 0 || page >= res.ResultInfo.TotalPages {
+			return zones, nil
+		}
+	}
+}
+
+// rest performs a request against the Cloudflare REST API and decodes the
+// response envelope into res.
+func (cf *Cloudflare) rest(ctx context.Context, method, endpoint string, res *restResponse) error {
+	req, err := http.NewRequestWithContext(ctx, method, cf.url+endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if err := cf.Auth.Authorize(ctx, req.Header); err != nil {
+		return errors.Wrap(err, "cloudflare: failed to authorize request")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	r, err := cf.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(res); err != nil {
+		if r.StatusCode >= http.StatusBadRequest {
+			return newError(r.StatusCode, "", r.Status)
+		}
+		return errors.Wrapf(err, "cloudflare: failed to decode response (%s)", r.Status)
+	}
+	return res.err(r.StatusCode)
+}
+
+// ZoneFilter selects which discovered zones are exported.
+//
+// A zone must match every non-empty field to be selected. Include and Exclude
+// are lists of glob patterns (see path.Match) matched against the zone name,
+// Accounts is a list of account IDs and Plans is a list of plan names or
+// legacy plan IDs (free, pro, business, enterprise).
+type ZoneFilter struct {
+	Include  []string
+	Exclude  []string
+	Accounts []string
+	Plans    []string
+}
+
+// Match reports whether the zone is selected by the filter.
+func (f ZoneFilter) Match(z ZoneInfo) bool {
+	if len(f.Include) > 0 && !matchGlob(f.Include, z.Name) {
+		return false
+	}
+	if matchGlob(f.Exclude, z.Name) {
+		return false
+	}
+	if len(f.Accounts) > 0 && !matchFold(f.Accounts, z.Account.ID) {
+		return false
+	}
+	if len(f.Plans) > 0 &&
+		!matchFold(f.Plans, z.Plan.Name) &&
+		!matchFold(f.Plans, z.Plan.LegacyID) {
+		return false
+	}
+	return true
+}
+
+// Validate returns an error if any of the glob patterns are malformed.
+func (f ZoneFilter) Validate() error {
+	for _, p := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.Wrapf(err, "cloudflare: invalid zone pattern \"%s\"", p)
+		}
+	}
+	return nil
+}
+
+func matchGlob(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFold(values []string, v string) bool {
+	if v == "" {
+		return false
+	}
+	for _, s := range values {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
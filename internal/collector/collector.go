@@ -0,0 +1,637 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+// Package collector ...
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+	"github.com/matthewpi/cloudflare-exporter/internal/state"
+)
+
+// Zone .
+type Zone struct {
+	// ID .
+	ID string
+
+	// Account is the name of the account whose credentials read the zone.
+	Account string
+
+	// Name is the display name used in the zone label.
+	Name string
+
+	// Labels are additional static labels added to every series of the zone.
+	Labels map[string]string
+
+	// Datasets collected for the zone, if empty every dataset is collected.
+	Datasets []cloudflare.Dataset
+
+	// Client used to query the zone.
+	Client *cloudflare.Cloudflare
+}
+
+// metricsZone returns the labels identifying the zone's series.
+func (z Zone) metricsZone() metrics.Zone {
+	return metrics.NewZone(z.Account, z.Name, z.Labels)
+}
+
+// Collector .
+type Collector struct {
+	// lag is how far behind the current time the collector queries,
+	// Cloudflare takes a few minutes before analytics for a minute are
+	// complete.
+	lag time.Duration
+
+	// lookback is the maximum age of a missed window that will be backfilled.
+	lookback time.Duration
+
+	// run is read locked while collecting and locked by anything that needs
+	// no collection to be running, such as taking a snapshot.
+	run sync.RWMutex
+
+	// mu guards ingested, skipped and running.
+	mu sync.Mutex
+
+	// ingested is the end of the last window ingested for each zone and
+	// dataset.
+	ingested map[string]map[cloudflare.Dataset]time.Time
+
+	// skipped is the time until which a zone and dataset are not queried
+	// after an error that will not go away by retrying, such as a dataset that
+	// is not available on the plan of the zone.
+	skipped map[string]map[cloudflare.Dataset]time.Time
+
+	// running contains every zone and dataset currently being collected, so
+	// concurrent collections never query the same zone and dataset twice.
+	running map[string]map[cloudflare.Dataset]struct{}
+
+	// ledger records the windows that have been applied to the counters.
+	ledger *ledger
+}
+
+// skipFor is how long a zone and dataset are skipped after a skippable error.
+const skipFor = time.Hour
+
+// New .
+func New(lag, lookback time.Duration) *Collector {
+	if lookback < time.Minute {
+		lookback = time.Minute
+	}
+	return &Collector{
+		lag:      lag,
+		lookback: lookback,
+		ingested: map[string]map[cloudflare.Dataset]time.Time{},
+		skipped:  map[string]map[cloudflare.Dataset]time.Time{},
+		running:  map[string]map[cloudflare.Dataset]struct{}{},
+		ledger:   newLedger(),
+	}
+}
+
+// query is a query sent by a single client.
+type query struct {
+	account string
+	client  *cloudflare.Cloudflare
+	cloudflare.Query
+
+	// probe is the registry of a probe, the zones' exporter series are
+	// created in it instead of the global series and errors never cause a
+	// zone to be skipped, as a probed zone may not be exported at all.
+	probe *metrics.Registry
+}
+
+// zone returns the zone the exporter series of z are created for.
+func (q *query) zone(z Zone) metrics.Zone {
+	mz := z.metricsZone()
+	if q.probe != nil {
+		return q.probe.Zone(mz)
+	}
+	return mz
+}
+
+// Collect queries the datasets of every zone since the window it last
+// ingested, going back no further than the lookback, and updates the metrics.
+//
+// Zones and datasets that have not been ingested before only query the most
+// recent complete minute. Zones and datasets that are still being collected by
+// another call are skipped.
+func (c *Collector) Collect(ctx context.Context, zones []Zone) error {
+	c.run.RLock()
+	defer c.run.RUnlock()
+
+	end := time.Now().Add(-c.lag).UTC().Truncate(time.Minute)
+	c.ledger.prune(end.Add(-c.lookback))
+
+	byID := make(map[string]Zone, len(zones))
+	queries := map[string]*query{}
+	var keys []string
+	for _, z := range zones {
+		byID[z.ID] = z
+
+		datasets := z.Datasets
+		if len(datasets) == 0 {
+			datasets = cloudflare.Datasets
+		}
+		byWindow := map[state.Span][]cloudflare.Dataset{}
+		for _, d := range datasets {
+			if c.isSkipped(z.ID, d) {
+				continue
+			}
+			start := c.start(z.ID, d, end)
+			if !start.Before(end) {
+				continue
+			}
+			if !c.claim(z.ID, d) {
+				metrics.ExporterCollectionsSkipped(
+					z.metricsZone(),
+					string(d),
+				).Inc()
+				fmt.Printf("skipping %s for zone %s, it is still being collected\n", d, z.Name)
+				continue
+			}
+			defer c.release(z.ID, d)
+
+			// Only query the parts of the window that have not been applied
+			// yet, such as the minutes around a window restored from the
+			// state file.
+			gaps := c.ledger.gaps(z.ID, d, start, end)
+			if len(gaps) == 0 {
+				c.setIngested(z.ID, []cloudflare.Dataset{d}, end)
+				continue
+			}
+			for _, w := range gaps {
+				byWindow[w] = append(byWindow[w], d)
+			}
+		}
+
+		// Group zones that share a client, window and datasets into the same
+		// query so they are batched together.
+		for w, datasets := range byWindow {
+			k := fmt.Sprintf("%p,%s,%s", z.Client, w.Start, w.End)
+			for _, d := range datasets {
+				k += "," + string(d)
+			}
+			q, ok := queries[k]
+			if !ok {
+				q = &query{
+					account: z.Account,
+					client:  z.Client,
+					Query:   cloudflare.Query{Datasets: datasets, Start: w.Start, End: w.End},
+				}
+				queries[k] = q
+				keys = append(keys, k)
+			}
+			q.Zones = append(q.Zones, z.ID)
+		}
+	}
+
+	// Query the windows of every zone and dataset in order, so the ingested
+	// window only advances while every earlier window succeeded.
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := queries[keys[i]], queries[keys[j]]
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		return keys[i] < keys[j]
+	})
+
+	// stalled holds the zones and datasets with a window that was not
+	// applied, later windows are applied but the ingested window stays
+	// before the missing one so it is queried again.
+	stalled := map[string]map[cloudflare.Dataset]struct{}{}
+	stall := func(id string, d cloudflare.Dataset) {
+		if stalled[id] == nil {
+			stalled[id] = map[cloudflare.Dataset]struct{}{}
+		}
+		stalled[id][d] = struct{}{}
+	}
+
+	var errs []string
+	for _, k := range keys {
+		q := queries[k]
+
+		r, failed, err := c.query(ctx, byID, q)
+		if err != nil {
+			errs = append(errs, err.Error())
+			for _, id := range q.Zones {
+				for _, d := range q.Datasets {
+					stall(id, d)
+				}
+			}
+			continue
+		}
+
+		// Record every window in the ledger before ingesting it, the rows of a
+		// window that has already been applied are dropped instead.
+		done := map[string][]cloudflare.Dataset{}
+		applied := map[string]map[cloudflare.Dataset]struct{}{}
+		for _, id := range q.Zones {
+			zone := byID[id]
+			applied[id] = map[cloudflare.Dataset]struct{}{}
+			for _, d := range q.Datasets {
+				if _, ok := failed[id][d]; ok {
+					stall(id, d)
+					continue
+				}
+				done[id] = append(done[id], d)
+				if !c.ledger.apply(id, d, q.Start, q.End) {
+					metrics.ExporterDuplicatesDropped(
+						zone.metricsZone(),
+						string(d),
+					).Inc()
+					fmt.Printf(
+						"dropping %s for zone %s between %s and %s, already applied\n",
+						d,
+						zone.Name,
+						q.Start.Format(time.RFC3339),
+						q.End.Format(time.RFC3339),
+					)
+					continue
+				}
+				applied[id][d] = struct{}{}
+			}
+		}
+
+		for i := range r.Viewer.Zones {
+			z := &r.Viewer.Zones[i]
+			zone := byID[z.ZoneID]
+			mz := zone.metricsZone()
+			for _, d := range cloudflare.Datasets {
+				if _, ok := applied[z.ZoneID][d]; !ok {
+					z.Clear(d)
+					continue
+				}
+				metrics.ExporterRowsReturned(mz, string(d)).Set(float64(z.Rows(d)))
+			}
+			ingest(mz, z)
+		}
+
+		now := float64(time.Now().Unix())
+		for _, id := range q.Zones {
+			if len(done[id]) == 0 {
+				continue
+			}
+			var advance []cloudflare.Dataset
+			for _, d := range done[id] {
+				if _, ok := stalled[id][d]; !ok {
+					advance = append(advance, d)
+				}
+			}
+			c.setIngested(id, advance, q.End)
+
+			zone := byID[id]
+			metrics.ExporterLastSuccess(zone.metricsZone()).Set(now)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// query sends the query and records its outcome, returning the datasets that
+// failed for each zone.
+func (c *Collector) query(
+	ctx context.Context,
+	byID map[string]Zone,
+	q *query,
+) (cloudflare.Response, map[string]map[cloudflare.Dataset]struct{}, error) {
+	started := time.Now()
+	r, err := q.client.Query(ctx, q.Query)
+	for _, d := range q.Datasets {
+		metrics.ExporterFetchDuration(q.account, string(d)).UpdateDuration(started)
+	}
+	if err != nil {
+		class := errorClass(err)
+		for _, d := range q.Datasets {
+			metrics.ExporterFetchFailures(q.account, string(d), class).Inc()
+		}
+		return cloudflare.Response{}, nil, err
+	}
+	for _, d := range q.Datasets {
+		metrics.ExporterFetchSuccesses(q.account, string(d)).Inc()
+	}
+	metrics.ExporterResponseSize(q.account).Update(float64(r.Bytes))
+
+	for _, t := range r.Truncated {
+		zone := byID[t.ZoneID]
+		metrics.ExporterTruncated(
+			q.zone(zone),
+			string(t.Dataset),
+		).Inc()
+		fmt.Printf(
+			"truncated %s for zone %s between %s and %s, consider increasing the limit\n",
+			t.Dataset,
+			zone.Name,
+			t.Start.Format(time.RFC3339),
+			t.End.Format(time.RFC3339),
+		)
+	}
+
+	return r, c.zoneErrors(byID, q, r.Errors), nil
+}
+
+// start returns the start of the window that needs to be queried for the
+// zone and dataset.
+func (c *Collector) start(zone string, d cloudflare.Dataset, end time.Time) time.Time {
+	c.mu.Lock()
+	last, ok := c.ingested[zone][d]
+	c.mu.Unlock()
+
+	if !ok {
+		return end.Add(-time.Minute)
+	}
+	if min := end.Add(-c.lookback); last.Before(min) {
+		fmt.Printf(
+			"unable to backfill %s for zone %s between %s and %s, exceeds lookback\n",
+			d,
+			zone,
+			last.Format(time.RFC3339),
+			min.Format(time.RFC3339),
+		)
+		return min
+	}
+	return last
+}
+
+// setIngested records that the window ending at end was ingested for every
+// dataset of the zone.
+func (c *Collector) setIngested(zone string, datasets []cloudflare.Dataset, end time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.ingested[zone]
+	if !ok {
+		m = map[cloudflare.Dataset]time.Time{}
+		c.ingested[zone] = m
+	}
+	for _, d := range datasets {
+		m[d] = end
+	}
+}
+
+// zoneErrors records the errors that affected some zones or datasets of the
+// query and returns the datasets that failed for each zone.
+//
+// Skippable errors cause the zone and dataset to be skipped for a while,
+// unless the query is a probe.
+func (c *Collector) zoneErrors(
+	byID map[string]Zone,
+	q *query,
+	errs []*cloudflare.Error,
+) map[string]map[cloudflare.Dataset]struct{} {
+	failed := map[string]map[cloudflare.Dataset]struct{}{}
+	for _, e := range errs {
+		skip := e.Skippable() && q.probe == nil
+		zones := q.Zones
+		if e.ZoneID != "" {
+			zones = []string{e.ZoneID}
+		}
+		datasets := q.Datasets
+		if e.Dataset != "" {
+			datasets = []cloudflare.Dataset{e.Dataset}
+		}
+
+		for _, id := range zones {
+			zone, ok := byID[id]
+			if !ok {
+				continue
+			}
+			if failed[id] == nil {
+				failed[id] = map[cloudflare.Dataset]struct{}{}
+			}
+			mz := q.zone(zone)
+			for _, d := range datasets {
+				failed[id][d] = struct{}{}
+				metrics.ExporterZoneErrors(mz, string(d), string(e.Kind)).Inc()
+				if skip {
+					c.skip(id, d)
+				}
+			}
+
+			if skip {
+				fmt.Printf(
+					"skipping %s for zone %s for %s: %s\n",
+					datasetList(datasets),
+					zone.Name,
+					skipFor,
+					e.Message,
+				)
+			} else {
+				fmt.Printf(
+					"failed to get %s for zone %s (%s): %s\n",
+					datasetList(datasets),
+					zone.Name,
+					e.Kind,
+					e.Message,
+				)
+			}
+		}
+	}
+	return failed
+}
+
+// claim marks the zone and dataset as being collected, returning false if they
+// already are.
+func (c *Collector) claim(zone string, d cloudflare.Dataset) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.running[zone]
+	if !ok {
+		m = map[cloudflare.Dataset]struct{}{}
+		c.running[zone] = m
+	}
+	if _, ok := m[d]; ok {
+		return false
+	}
+	m[d] = struct{}{}
+	return true
+}
+
+// release marks the zone and dataset as no longer being collected.
+func (c *Collector) release(zone string, d cloudflare.Dataset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.running[zone], d)
+	if len(c.running[zone]) == 0 {
+		delete(c.running, zone)
+	}
+}
+
+// skip skips the zone and dataset until skipFor has passed.
+func (c *Collector) skip(zone string, d cloudflare.Dataset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.skipped[zone]
+	if !ok {
+		m = map[cloudflare.Dataset]time.Time{}
+		c.skipped[zone] = m
+	}
+	m[d] = time.Now().Add(skipFor)
+}
+
+// isSkipped reports whether the zone and dataset are currently skipped.
+func (c *Collector) isSkipped(zone string, d cloudflare.Dataset) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.skipped[zone][d]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(c.skipped[zone], d)
+		return false
+	}
+	return true
+}
+
+// datasetList returns the datasets as a comma separated list.
+func datasetList(datasets []cloudflare.Dataset) string {
+	l := make([]string, len(datasets))
+	for i, d := range datasets {
+		l[i] = string(d)
+	}
+	return strings.Join(l, ", ")
+}
+
+// Snapshot returns the value of every counter along with the windows that have
+// been ingested. The snapshot is taken while no collection is running so the
+// counters always match the ingested windows.
+func (c *Collector) Snapshot() *state.State {
+	c.run.Lock()
+	defer c.run.Unlock()
+
+	c.mu.Lock()
+	ingested := make(map[string]map[cloudflare.Dataset]time.Time, len(c.ingested))
+	for z, m := range c.ingested {
+		ingested[z] = make(map[cloudflare.Dataset]time.Time, len(m))
+		for d, t := range m {
+			ingested[z][d] = t
+		}
+	}
+	c.mu.Unlock()
+
+	return &state.State{
+		Counters: metrics.Counters(),
+		Ingested: ingested,
+		Applied:  c.ledger.snapshot(),
+	}
+}
+
+// Restore restores the counters and ingested windows from a snapshot.
+func (c *Collector) Restore(s *state.State) {
+	c.run.Lock()
+	defer c.run.Unlock()
+
+	metrics.RestoreCounters(s.Counters)
+
+	c.mu.Lock()
+	for z, m := range s.Ingested {
+		c.ingested[z] = make(map[cloudflare.Dataset]time.Time, len(m))
+		for d, t := range m {
+			c.ingested[z][d] = t
+		}
+	}
+	c.mu.Unlock()
+
+	c.ledger.restore(s.Applied)
+}
+
+// Configure changes the lag and lookback of the collector.
+func (c *Collector) Configure(lag, lookback time.Duration) {
+	if lookback < time.Minute {
+		lookback = time.Minute
+	}
+
+	c.run.Lock()
+	c.lag, c.lookback = lag, lookback
+	c.run.Unlock()
+
+	// The configuration may have fixed whatever caused zones to be skipped.
+	c.mu.Lock()
+	c.skipped = map[string]map[cloudflare.Dataset]time.Time{}
+	c.mu.Unlock()
+}
+
+// Prune removes the series of every zone in old that is no longer in current,
+// along with the ingested windows of zones whose ID is no longer in current.
+func (c *Collector) Prune(old, current []Zone) {
+	ids := make(map[string]struct{}, len(current))
+	keep := make(map[metrics.Zone]struct{}, len(current))
+	for _, z := range current {
+		ids[z.ID] = struct{}{}
+		keep[z.metricsZone()] = struct{}{}
+	}
+
+	c.run.Lock()
+	defer c.run.Unlock()
+	for _, z := range old {
+		mz := z.metricsZone()
+		if _, ok := keep[mz]; !ok {
+			metrics.Unregister(mz)
+		}
+		if _, ok := ids[z.ID]; !ok {
+			c.mu.Lock()
+			delete(c.ingested, z.ID)
+			delete(c.skipped, z.ID)
+			c.mu.Unlock()
+			c.ledger.remove(z.ID)
+		}
+	}
+}
+
+// Retain removes the series and ingested windows of every zone that is not in
+// current, including any restored from a snapshot.
+func (c *Collector) Retain(current []Zone) {
+	ids := make(map[string]struct{}, len(current))
+	keep := make([]metrics.Zone, 0, len(current))
+	for _, z := range current {
+		ids[z.ID] = struct{}{}
+		keep = append(keep, z.metricsZone())
+	}
+
+	c.run.Lock()
+	defer c.run.Unlock()
+	metrics.UnregisterExcept(keep)
+
+	c.mu.Lock()
+	for id := range c.ingested {
+		if _, ok := ids[id]; !ok {
+			delete(c.ingested, id)
+		}
+	}
+	for id := range c.skipped {
+		if _, ok := ids[id]; !ok {
+			delete(c.skipped, id)
+		}
+	}
+	c.mu.Unlock()
+	c.ledger.retain(ids)
+}
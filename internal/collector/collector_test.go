@@ -0,0 +1,170 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package collector_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare/fake"
+	"github.com/matthewpi/cloudflare-exporter/internal/collector"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+	"github.com/matthewpi/cloudflare-exporter/internal/state"
+)
+
+func TestCollect(t *testing.T) {
+	cf, srv := fake.NewClient(t)
+
+	// Fill the minutes around the collected one, so the test does not depend
+	// on which minute is the most recent complete one.
+	lag := 3 * time.Minute
+	now := time.Now().Add(-lag).UTC().Truncate(time.Minute)
+	srv.AddZone(cloudflare.ZoneInfo{ID: "a", Name: "a.example"})
+	for i := -3; i <= 1; i++ {
+		var z cloudflare.Zone
+		z.HTTPRequests1mGroups = []cloudflare.HTTPRequest1m{{}}
+		z.HTTPRequests1mGroups[0].Sum.Requests = 7
+		srv.AddRows("a", now.Add(time.Duration(i)*time.Minute), z)
+	}
+	srv.FailDataset("a", cloudflare.DatasetFirewallEvents, "zone does not have access to the path")
+
+	zone := collector.Zone{
+		ID:      "a",
+		Account: "test",
+		Name:    "a.example",
+		Datasets: []cloudflare.Dataset{
+			cloudflare.DatasetFirewallEvents,
+			cloudflare.DatasetHTTPRequests1m,
+		},
+		Client: cf,
+	}
+	c := fake.NewCollector(lag, time.Hour, zone)
+	if err := c.Collect(context.Background(), []collector.Zone{zone}); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	metrics.WritePrometheus(&b, false)
+	for _, s := range []string{
+		`cloudflare_zone_requests_total{account="test",zone="a.example"} 7`,
+		`cloudflare_exporter_zone_errors_total{account="test",zone="a.example",dataset="firewallEventsAdaptiveGroups",kind="permission"} 1`,
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected %s in:\n%s", s, b.String())
+		}
+	}
+}
+
+func TestCollectSkipsAppliedMinutes(t *testing.T) {
+	cf, srv := fake.NewClient(t)
+
+	lag := 3 * time.Minute
+	end := fake.End(lag)
+	srv.AddZone(cloudflare.ZoneInfo{ID: "b", Name: "b.example"})
+	for i, n := range []uint64{1, 10, 100} {
+		var z cloudflare.Zone
+		z.HTTPRequests1mGroups = []cloudflare.HTTPRequest1m{{}}
+		z.HTTPRequests1mGroups[0].Sum.Requests = n
+		srv.AddRows("b", end.Add(time.Duration(i-3)*time.Minute), z)
+	}
+
+	// The middle minute of the backfilled window has been applied already.
+	d := cloudflare.DatasetHTTPRequests1m
+	zone := collector.Zone{
+		ID:       "b",
+		Account:  "test",
+		Name:     "b.example",
+		Datasets: []cloudflare.Dataset{d},
+		Client:   cf,
+	}
+	c := fake.NewCollector(lag, time.Hour, zone)
+	c.Restore(&state.State{
+		Ingested: map[string]map[cloudflare.Dataset]time.Time{
+			"b": {d: end.Add(-3 * time.Minute)},
+		},
+		Applied: map[string]map[cloudflare.Dataset][]state.Span{
+			"b": {d: {{Start: end.Add(-2 * time.Minute), End: end.Add(-time.Minute)}}},
+		},
+	})
+	if err := c.Collect(context.Background(), []collector.Zone{zone}); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	metrics.WritePrometheus(&b, false)
+	want := `cloudflare_zone_requests_total{account="test",zone="b.example"} 101`
+	if !strings.Contains(b.String(), want) {
+		t.Errorf("expected %s in:\n%s", want, b.String())
+	}
+
+	applied := c.Snapshot().Applied["b"][d]
+	if len(applied) != 1 || !applied[0].Start.Equal(end.Add(-3*time.Minute)) || !applied[0].End.Equal(end) {
+		t.Errorf("expected the whole window to be applied, got %v", applied)
+	}
+}
+
+func TestRetain(t *testing.T) {
+	gone := `cloudflare_zone_requests_total{account="retain",zone="gone.example"}`
+	kept := `cloudflare_zone_requests_total{account="retain",zone="kept.example"}`
+	d := cloudflare.DatasetHTTPRequests1m
+	now := time.Now().UTC().Truncate(time.Minute)
+
+	// The state was saved before gone.example was removed from the
+	// configuration.
+	c := collector.New(time.Minute, time.Hour)
+	c.Restore(&state.State{
+		Counters: map[string]uint64{gone: 3, kept: 5},
+		Ingested: map[string]map[cloudflare.Dataset]time.Time{
+			"gone": {d: now},
+			"kept": {d: now},
+		},
+		Applied: map[string]map[cloudflare.Dataset][]state.Span{
+			"gone": {d: {{Start: now.Add(-time.Minute), End: now}}},
+		},
+	})
+	c.Retain([]collector.Zone{{ID: "kept", Account: "retain", Name: "kept.example"}})
+
+	var b bytes.Buffer
+	metrics.WritePrometheus(&b, false)
+	if strings.Contains(b.String(), gone) {
+		t.Errorf("expected the removed zone's series to be unregistered:\n%s", b.String())
+	}
+	if !strings.Contains(b.String(), kept+" 5") {
+		t.Errorf("expected %s 5 in:\n%s", kept, b.String())
+	}
+
+	s := c.Snapshot()
+	if _, ok := s.Ingested["gone"]; ok {
+		t.Error("expected the ingested windows of the removed zone to be dropped")
+	}
+	if _, ok := s.Applied["gone"]; ok {
+		t.Error("expected the applied windows of the removed zone to be dropped")
+	}
+	if _, ok := s.Ingested["kept"]; !ok {
+		t.Error("expected the ingested windows of the remaining zone to be kept")
+	}
+}
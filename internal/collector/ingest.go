@@ -0,0 +1,197 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package collector
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+)
+
+// ingest updates the metrics of a zone using every row in z.
+func ingest(zone metrics.Zone, z *cloudflare.Zone) {
+	// FirewallEventsAdaptiveGroups
+	for _, e := range z.FirewallEventsAdaptiveGroups {
+		metrics.ZoneFirewallEvents(
+			zone,
+			e.Dimensions.Action,
+			e.Dimensions.Source,
+			e.Dimensions.ClientRequestHTTPHost,
+			e.Dimensions.ClientCountryName,
+		).Add(int(e.Count))
+	}
+	// END FirewallEventsAdaptiveGroups
+
+	// HealthCheckEventsAdaptive
+	latest := map[[2]string]cloudflare.HealthCheckEvent{}
+	for _, e := range z.HealthCheckEventsAdaptive {
+		metrics.ZoneHealthCheckRTT(zone, e.HealthCheckName, e.Region).
+			Update(float64(e.RttMs))
+		metrics.ZoneHealthCheckTCPConn(zone, e.HealthCheckName, e.Region).
+			Update(float64(e.TCPConnMs))
+		metrics.ZoneHealthCheckTLSHandshake(zone, e.HealthCheckName, e.Region).
+			Update(float64(e.TLSHandshakeMs))
+		metrics.ZoneHealthCheckTTFB(zone, e.HealthCheckName, e.Region).
+			Update(float64(e.TimeToFirstByteMs))
+
+		// Each row is a sampled event that represents sampleInterval events.
+		if e.HealthChanged != 0 {
+			n := int(e.SampleInterval)
+			if n < 1 {
+				n = 1
+			}
+			metrics.ZoneHealthCheckChanges(zone, e.HealthCheckName, e.Region, e.FailureReason).
+				Add(int(e.HealthChanged) * n)
+		}
+
+		k := [2]string{e.HealthCheckName, e.Region}
+		if l, ok := latest[k]; !ok || e.DateTime.After(l.DateTime) {
+			latest[k] = e
+		}
+	}
+	for _, e := range latest {
+		var healthy float64
+		if strings.EqualFold(e.HealthStatus, "healthy") {
+			healthy = 1
+		}
+		metrics.ZoneHealthCheckHealthy(zone, e.HealthCheckName, e.Region).Set(healthy)
+	}
+	// END HealthCheckEventsAdaptive
+
+	// HTTPRequests1mGroups
+	var latest1m time.Time
+	for _, e := range z.HTTPRequests1mGroups {
+		metrics.ZoneRequestsTotal(zone).Add(int(e.Sum.Requests))
+		metrics.ZoneRequestsCached(zone).Add(int(e.Sum.CachedRequests))
+		metrics.ZoneRequestsEncrypted(zone).Add(int(e.Sum.EncryptedRequests))
+
+		metrics.ZoneBandwidthTotal(zone).Add(int(e.Sum.Bytes))
+		metrics.ZoneBandwidthCached(zone).Add(int(e.Sum.CachedBytes))
+		metrics.ZoneBandwidthEncrypted(zone).Add(int(e.Sum.EncryptedBytes))
+
+		metrics.ZoneThreatsTotal(zone).Add(int(e.Sum.Threats))
+
+		for _, ct := range e.Sum.ContentTypeMap {
+			metrics.ZoneRequestsContentType(zone, ct.EdgeResponseContentType).
+				Add(int(ct.Requests))
+			metrics.ZoneBandwidthContentType(zone, ct.EdgeResponseContentType).
+				Add(int(ct.Bytes))
+		}
+
+		for _, c := range e.Sum.CountryMap {
+			metrics.ZoneRequestsCountry(zone, c.ClientCountryName).
+				Add(int(c.Requests))
+			metrics.ZoneBandwidthCountry(zone, c.ClientCountryName).
+				Add(int(c.Bytes))
+			metrics.ZoneThreatsCountry(zone, c.ClientCountryName).
+				Add(int(c.Threats))
+		}
+
+		for _, s := range e.Sum.ResponseStatusMap {
+			metrics.ZoneRequestsStatus(zone, strconv.Itoa(s.EdgeResponseStatus)).
+				Add(int(s.Requests))
+		}
+
+		for _, t := range e.Sum.ThreatPathingMap {
+			metrics.ZoneThreatsType(zone, t.Name).Add(int(t.Requests))
+		}
+
+		for _, v := range e.Sum.ClientHTTPVersionMap {
+			metrics.ZoneRequestsHTTPVersion(zone, v.Protocol).Add(int(v.Requests))
+		}
+
+		for _, v := range e.Sum.ClientSSLMap {
+			metrics.ZoneRequestsTLSVersion(zone, v.Protocol).Add(int(v.Requests))
+		}
+
+		for _, c := range e.Sum.IPClassMap {
+			metrics.ZoneRequestsIPClass(zone, c.Type).Add(int(c.Requests))
+		}
+
+		metrics.ZonePageViewsTotal(zone).Add(int(e.Sum.PageViews))
+		for _, b := range e.Sum.BrowserMap {
+			metrics.ZonePageViewsBrowser(zone, b.UABrowserFamily).Add(int(b.PageViews))
+		}
+
+		if e.Dimensions.DateTime.After(latest1m) {
+			latest1m = e.Dimensions.DateTime
+			metrics.ZoneUniques(zone).Set(float64(e.Unique.Uniques))
+		}
+	}
+	// END HTTPRequests1mGroups
+
+	// HTTPRequestsAdaptiveGroups
+	for _, e := range z.HTTPRequestsAdaptiveGroups {
+		metrics.ZoneColocationVisits(zone, e.Dimensions.ColoCode).Add(int(e.Sum.Visits))
+		metrics.ZoneColocationResponseBytes(zone, e.Dimensions.ColoCode).
+			Add(int(e.Sum.EdgeResponseBytes))
+	}
+	// END HTTPRequestsAdaptiveGroups
+
+	// LoadBalancingRequestsAdaptive
+	lbs := map[string]cloudflare.LoadBalancingRequest{}
+	for _, e := range z.LoadBalancingRequestsAdaptive {
+		// Each row is a sampled request that represents sampleInterval
+		// requests.
+		n := int(e.SampleInterval)
+		if n < 1 {
+			n = 1
+		}
+		metrics.ZoneLoadBalancerRequests(
+			zone,
+			e.LBName,
+			e.SelectedPoolName,
+			e.SelectedOriginName,
+			e.ColoCode,
+		).Add(n)
+		if e.ErrorType != "" && e.ErrorType != "none" {
+			metrics.ZoneLoadBalancerErrors(zone, e.LBName, e.ErrorType).Add(n)
+		}
+		metrics.ZoneLoadBalancerSteeringPolicy(zone, e.LBName, e.SteeringPolicy).Add(n)
+
+		if l, ok := lbs[e.LBName]; !ok || e.DateTime.After(l.DateTime) {
+			lbs[e.LBName] = e
+		}
+	}
+	for _, e := range lbs {
+		for _, p := range e.Pools {
+			metrics.ZoneLoadBalancerPoolHealthy(zone, e.LBName, p.PoolName).
+				Set(float64(p.Healthy))
+			metrics.ZoneLoadBalancerPoolRTT(zone, e.LBName, p.PoolName).
+				Set(float64(p.AvgRttMs))
+		}
+		for _, o := range e.Origins {
+			metrics.ZoneLoadBalancerOriginHealthy(zone, e.LBName, o.OriginName).
+				Set(float64(o.Health))
+			var weight float64
+			if o.Selected != 0 {
+				weight = o.Weight
+			}
+			metrics.ZoneLoadBalancerOriginWeight(zone, e.LBName, o.OriginName).Set(weight)
+		}
+	}
+	// END LoadBalancingRequestsAdaptive
+}
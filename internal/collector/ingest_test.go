@@ -0,0 +1,160 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package collector_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare/fake"
+	"github.com/matthewpi/cloudflare-exporter/internal/collector"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestIngestGolden collects every canned response in testdata from a fake
+// server and compares the zone series served on /metrics to its golden file.
+// Run the test with -update to regenerate the golden files after an intended
+// change.
+func TestIngestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no canned responses found in testdata")
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var res cloudflare.Response
+			if err := json.Unmarshal(b, &res); err != nil {
+				t.Fatal(err)
+			}
+
+			cf, srv := fake.NewClient(t)
+
+			// Serve the rows as the most recent complete minute, which is the
+			// only minute a first collection queries. Every file collects
+			// into its own account, so files cannot share series.
+			lag := 3 * time.Minute
+			end := fake.End(lag)
+			var zones []collector.Zone
+			for _, z := range res.Viewer.Zones {
+				srv.AddZone(cloudflare.ZoneInfo{ID: z.ZoneID, Name: z.ZoneID})
+				srv.AddRows(z.ZoneID, end.Add(-time.Minute), z)
+				zones = append(zones, collector.Zone{
+					ID:      z.ZoneID,
+					Account: name,
+					Name:    z.ZoneID,
+					Labels:  map[string]string{"env": "test"},
+					Client:  cf,
+				})
+			}
+
+			c := fake.NewCollector(lag, time.Hour, zones...)
+			if err := c.Collect(context.Background(), zones); err != nil {
+				t.Fatal(err)
+			}
+
+			var got bytes.Buffer
+			metrics.WritePrometheus(&got, false)
+			zoneSeries(t, &got, name)
+
+			golden := filepath.Join("testdata", name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run the test with -update to create it)", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("exposition does not match %s, run the test with -update if the change is intended\n%s", golden, diff(string(want), got.String()))
+			}
+		})
+	}
+}
+
+// zoneSeries keeps only the lines of the zone series collected into account,
+// the exporter's own series depend on timing and other tests.
+func zoneSeries(t *testing.T, b *bytes.Buffer, account string) {
+	t.Helper()
+
+	var out bytes.Buffer
+	sc := bufio.NewScanner(b)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "cloudflare_zone_") && strings.Contains(line, `{account="`+account+`",`) {
+			out.WriteString(line + "\n")
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	*b = out
+}
+
+// diff returns the lines only present in want prefixed by "-" and the lines
+// only present in got prefixed by "+".
+func diff(want, got string) string {
+	in := func(s string) map[string]bool {
+		m := map[string]bool{}
+		for _, l := range strings.Split(s, "\n") {
+			m[l] = true
+		}
+		return m
+	}
+	w, g := in(want), in(got)
+
+	var b strings.Builder
+	for _, l := range strings.Split(want, "\n") {
+		if !g[l] {
+			b.WriteString("-" + l + "\n")
+		}
+	}
+	for _, l := range strings.Split(got, "\n") {
+		if !w[l] {
+			b.WriteString("+" + l + "\n")
+		}
+	}
+	return b.String()
+}
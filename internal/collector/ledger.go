@@ -0,0 +1,187 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package collector
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/state"
+)
+
+// ledger records the windows whose rows have been applied to the counters for
+// each zone and dataset, and refuses to apply a window that overlaps any of
+// them. This makes ingestion idempotent, re-querying the same minute can never
+// count its rows twice.
+type ledger struct {
+	mu sync.Mutex
+
+	// spans are sorted by start and never overlap or touch.
+	spans map[string]map[cloudflare.Dataset][]state.Span
+}
+
+// newLedger .
+func newLedger() *ledger {
+	return &ledger{spans: map[string]map[cloudflare.Dataset][]state.Span{}}
+}
+
+// gaps returns the parts of the window between start and end that have not
+// been applied for the zone and dataset, in order.
+func (l *ledger) gaps(zone string, d cloudflare.Dataset, start, end time.Time) []state.Span {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var gaps []state.Span
+	for _, s := range l.spans[zone][d] {
+		if !s.End.After(start) {
+			continue
+		}
+		if !s.Start.Before(end) {
+			break
+		}
+		if s.Start.After(start) {
+			gaps = append(gaps, state.Span{Start: start, End: s.Start})
+		}
+		start = s.End
+	}
+	if start.Before(end) {
+		gaps = append(gaps, state.Span{Start: start, End: end})
+	}
+	return gaps
+}
+
+// apply records the window between start and end as applied for the zone and
+// dataset. If any part of the window has been applied already nothing is
+// recorded and false is returned.
+func (l *ledger) apply(zone string, d cloudflare.Dataset, start, end time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m, ok := l.spans[zone]
+	if !ok {
+		m = map[cloudflare.Dataset][]state.Span{}
+		l.spans[zone] = m
+	}
+	spans := m[d]
+
+	// Index of the first span that ends after start.
+	i := sort.Search(len(spans), func(i int) bool { return spans[i].End.After(start) })
+	if i < len(spans) && spans[i].Start.Before(end) {
+		return false
+	}
+
+	// Merge with the neighbouring spans when they touch.
+	s := state.Span{Start: start, End: end}
+	j := i
+	if i > 0 && spans[i-1].End.Equal(start) {
+		i--
+		s.Start = spans[i].Start
+	}
+	if j < len(spans) && spans[j].Start.Equal(end) {
+		s.End = spans[j].End
+		j++
+	}
+
+	merged := make([]state.Span, 0, len(spans)-(j-i)+1)
+	merged = append(merged, spans[:i]...)
+	merged = append(merged, s)
+	merged = append(merged, spans[j:]...)
+	m[d] = merged
+	return true
+}
+
+// prune forgets every part of a window before the cutoff, windows that old are
+// never queried again.
+func (l *ledger) prune(cutoff time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for zone, m := range l.spans {
+		for d, spans := range m {
+			i := sort.Search(len(spans), func(i int) bool { return spans[i].End.After(cutoff) })
+			spans = spans[i:]
+			if len(spans) > 0 && spans[0].Start.Before(cutoff) {
+				spans[0].Start = cutoff
+			}
+			if len(spans) == 0 {
+				delete(m, d)
+				continue
+			}
+			m[d] = spans
+		}
+		if len(m) == 0 {
+			delete(l.spans, zone)
+		}
+	}
+}
+
+// remove forgets every window of the zone.
+func (l *ledger) remove(zone string) {
+	l.mu.Lock()
+	delete(l.spans, zone)
+	l.mu.Unlock()
+}
+
+// retain forgets every window of the zones whose ID is not in ids.
+func (l *ledger) retain(ids map[string]struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for zone := range l.spans {
+		if _, ok := ids[zone]; !ok {
+			delete(l.spans, zone)
+		}
+	}
+}
+
+// snapshot returns a copy of every recorded window.
+func (l *ledger) snapshot() map[string]map[cloudflare.Dataset][]state.Span {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := make(map[string]map[cloudflare.Dataset][]state.Span, len(l.spans))
+	for zone, m := range l.spans {
+		c[zone] = make(map[cloudflare.Dataset][]state.Span, len(m))
+		for d, spans := range m {
+			c[zone][d] = append([]state.Span(nil), spans...)
+		}
+	}
+	return c
+}
+
+// restore replaces the windows of every zone in s.
+func (l *ledger) restore(s map[string]map[cloudflare.Dataset][]state.Span) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for zone, m := range s {
+		l.spans[zone] = make(map[cloudflare.Dataset][]state.Span, len(m))
+		for d, spans := range m {
+			spans = append([]state.Span(nil), spans...)
+			sort.Slice(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+			l.spans[zone][d] = spans
+		}
+	}
+}
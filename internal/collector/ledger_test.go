@@ -0,0 +1,175 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/state"
+)
+
+const dataset = cloudflare.DatasetHTTPRequests1m
+
+var t0 = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// at returns the time n minutes after t0.
+func at(n int) time.Time {
+	return t0.Add(time.Duration(n) * time.Minute)
+}
+
+// span returns the span between minutes start and end after t0.
+func span(start, end int) state.Span {
+	return state.Span{Start: at(start), End: at(end)}
+}
+
+func TestLedgerApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		applied []state.Span
+		window  state.Span
+		ok      bool
+		want    []state.Span
+	}{
+		{
+			name:   "empty",
+			window: span(0, 1),
+			ok:     true,
+			want:   []state.Span{span(0, 1)},
+		},
+		{
+			name:    "same window",
+			applied: []state.Span{span(0, 1)},
+			window:  span(0, 1),
+			want:    []state.Span{span(0, 1)},
+		},
+		{
+			name:    "overlaps start",
+			applied: []state.Span{span(2, 4)},
+			window:  span(1, 3),
+			want:    []state.Span{span(2, 4)},
+		},
+		{
+			name:    "overlaps end",
+			applied: []state.Span{span(2, 4)},
+			window:  span(3, 5),
+			want:    []state.Span{span(2, 4)},
+		},
+		{
+			name:    "covers span",
+			applied: []state.Span{span(2, 3)},
+			window:  span(1, 4),
+			want:    []state.Span{span(2, 3)},
+		},
+		{
+			name:    "adjacent after",
+			applied: []state.Span{span(0, 2)},
+			window:  span(2, 3),
+			ok:      true,
+			want:    []state.Span{span(0, 3)},
+		},
+		{
+			name:    "adjacent before",
+			applied: []state.Span{span(2, 3)},
+			window:  span(0, 2),
+			ok:      true,
+			want:    []state.Span{span(0, 3)},
+		},
+		{
+			name:    "fills gap",
+			applied: []state.Span{span(0, 1), span(2, 3)},
+			window:  span(1, 2),
+			ok:      true,
+			want:    []state.Span{span(0, 3)},
+		},
+		{
+			name:    "disjoint",
+			applied: []state.Span{span(0, 1), span(4, 5)},
+			window:  span(2, 3),
+			ok:      true,
+			want:    []state.Span{span(0, 1), span(2, 3), span(4, 5)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLedger()
+			for _, s := range tt.applied {
+				if !l.apply("a", dataset, s.Start, s.End) {
+					t.Fatalf("failed to apply %v", s)
+				}
+			}
+			if ok := l.apply("a", dataset, tt.window.Start, tt.window.End); ok != tt.ok {
+				t.Errorf("expected apply to return %t, got %t", tt.ok, ok)
+			}
+			if got := l.snapshot()["a"][dataset]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected spans %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLedgerGaps(t *testing.T) {
+	l := newLedger()
+	l.apply("a", dataset, at(1), at(2))
+	l.apply("a", dataset, at(3), at(5))
+
+	tests := []struct {
+		window state.Span
+		want   []state.Span
+	}{
+		{window: span(0, 6), want: []state.Span{span(0, 1), span(2, 3), span(5, 6)}},
+		{window: span(1, 2), want: nil},
+		{window: span(1, 5), want: []state.Span{span(2, 3)}},
+		{window: span(4, 6), want: []state.Span{span(5, 6)}},
+		{window: span(6, 7), want: []state.Span{span(6, 7)}},
+	}
+	for _, tt := range tests {
+		if got := l.gaps("a", dataset, tt.window.Start, tt.window.End); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expected gaps of %v to be %v, got %v", tt.window, tt.want, got)
+		}
+	}
+}
+
+func TestLedgerPrune(t *testing.T) {
+	l := newLedger()
+	l.apply("a", dataset, at(0), at(2))
+	l.apply("a", dataset, at(3), at(5))
+	l.apply("b", dataset, at(0), at(1))
+
+	l.prune(at(4))
+
+	s := l.snapshot()
+	if want := []state.Span{span(4, 5)}; !reflect.DeepEqual(s["a"][dataset], want) {
+		t.Errorf("expected spans %v, got %v", want, s["a"][dataset])
+	}
+	if _, ok := s["b"]; ok {
+		t.Error("expected the zone without spans after the cutoff to be removed")
+	}
+
+	// Pruned minutes are forgotten, so they can be applied again.
+	if !l.apply("a", dataset, at(3), at(4)) {
+		t.Error("expected a pruned window to be applied")
+	}
+}
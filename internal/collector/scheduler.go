@@ -0,0 +1,129 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+)
+
+// Scheduler runs a collection every interval.
+//
+// Only a single collection started by the scheduler runs at once, if a
+// collection is still running when the next one is due, the next one is
+// skipped and recorded.
+type Scheduler struct {
+	collector *Collector
+
+	// zones returns the zones to collect.
+	zones func() []Zone
+
+	// interval is the time between collections.
+	interval time.Duration
+
+	// timeout is the maximum duration of a single collection.
+	timeout time.Duration
+}
+
+// NewScheduler returns a Scheduler that collects the zones returned by zones
+// every interval, giving each collection at most timeout to complete.
+func NewScheduler(c *Collector, zones func() []Zone, interval, timeout time.Duration) *Scheduler {
+	return &Scheduler{
+		collector: c,
+		zones:     zones,
+		interval:  interval,
+		timeout:   timeout,
+	}
+}
+
+// Run collects immediately and then every interval, aligned to a multiple of
+// the interval, until ctx is done. Run only returns once the running
+// collection, if any, has been cancelled and returned.
+func (s *Scheduler) Run(ctx context.Context) {
+	var (
+		wg      sync.WaitGroup
+		running int32
+	)
+	defer wg.Wait()
+
+	run := func() {
+		if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+			metrics.ExporterRunsSkipped().Inc()
+			fmt.Println("skipping collection, the previous collection is still running")
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer atomic.StoreInt32(&running, 0)
+
+			if err := s.collect(ctx); err != nil {
+				fmt.Printf("failed to fetch metrics: %v\n", err)
+			}
+		}()
+	}
+
+	// Initially fetch the metrics.
+	run()
+
+	// Make the ticker start on a multiple of the interval so it runs exactly
+	// when the minute changes.
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Until(time.Now().Truncate(s.interval).Add(s.interval))):
+	}
+	run()
+
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			run()
+		}
+	}
+}
+
+// collect runs a single collection of every zone.
+func (s *Scheduler) collect(ctx context.Context) error {
+	zones := s.zones()
+	if len(zones) == 0 {
+		return nil
+	}
+
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	return s.collector.Collect(ctx, zones)
+}
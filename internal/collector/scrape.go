@@ -0,0 +1,229 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+)
+
+// Scrape queries the most recent complete minute of every zone and returns the
+// results in a new registry instead of adding them to the global series, along
+// with the start of the minute.
+//
+// Scrape does not backfill nor record the minute as ingested, so it is only
+// suitable when every scrape is expected to query the latest minute.
+func (c *Collector) Scrape(
+	ctx context.Context,
+	zones []Zone,
+) (*metrics.Registry, time.Time, error) {
+	return c.scrape(ctx, zones, false)
+}
+
+// scrape implements Scrape. When probing, the zones' exporter series are
+// created in the returned registry as well, so probing a zone leaves nothing
+// behind in the global series.
+func (c *Collector) scrape(
+	ctx context.Context,
+	zones []Zone,
+	probe bool,
+) (*metrics.Registry, time.Time, error) {
+	c.run.RLock()
+	defer c.run.RUnlock()
+
+	end := time.Now().Add(-c.lag).UTC().Truncate(time.Minute)
+	start := end.Add(-time.Minute)
+
+	reg := metrics.NewRegistry()
+	byID := make(map[string]Zone, len(zones))
+	queries := map[string]*query{}
+	var keys []string
+	for _, z := range zones {
+		byID[z.ID] = z
+
+		datasets := z.Datasets
+		if len(datasets) == 0 {
+			datasets = cloudflare.Datasets
+		}
+		var l []cloudflare.Dataset
+		for _, d := range datasets {
+			if !c.isSkipped(z.ID, d) {
+				l = append(l, d)
+			}
+		}
+		if len(l) == 0 {
+			continue
+		}
+
+		k := fmt.Sprintf("%p", z.Client)
+		for _, d := range l {
+			k += "," + string(d)
+		}
+		q, ok := queries[k]
+		if !ok {
+			q = &query{
+				account: z.Account,
+				client:  z.Client,
+				Query:   cloudflare.Query{Datasets: l, Start: start, End: end},
+			}
+			if probe {
+				q.probe = reg
+			}
+			queries[k] = q
+			keys = append(keys, k)
+		}
+		q.Zones = append(q.Zones, z.ID)
+	}
+
+	var errs []string
+	for _, k := range keys {
+		q := queries[k]
+		r, failed, err := c.query(ctx, byID, q)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		queried := make(map[cloudflare.Dataset]struct{}, len(q.Datasets))
+		for _, d := range q.Datasets {
+			queried[d] = struct{}{}
+		}
+
+		now := float64(time.Now().Unix())
+		for i := range r.Viewer.Zones {
+			z := &r.Viewer.Zones[i]
+			zone, ok := byID[z.ZoneID]
+			if !ok {
+				continue
+			}
+			mz := q.zone(zone)
+			for _, d := range cloudflare.Datasets {
+				_, ok := queried[d]
+				if _, failed := failed[z.ZoneID][d]; !ok || failed {
+					z.Clear(d)
+					continue
+				}
+				metrics.ExporterRowsReturned(mz, string(d)).Set(float64(z.Rows(d)))
+			}
+			ingest(reg.Zone(zone.metricsZone()), z)
+			metrics.ExporterLastSuccess(mz).Set(now)
+		}
+	}
+	if len(errs) > 0 {
+		return reg, start, errors.New(strings.Join(errs, "; "))
+	}
+	return reg, start, nil
+}
+
+// Scraper scrapes the zones whenever its series are written, caching the
+// result for a short time to protect the API from frequent scrapes.
+type Scraper struct {
+	collector *Collector
+
+	// zones returns the zones to scrape.
+	zones func() []Zone
+
+	// ttl is how long the result of a scrape is reused for.
+	ttl time.Duration
+
+	// timeout is the maximum duration of a single scrape.
+	timeout time.Duration
+
+	// probe is set if the scraper probes a zone, see NewProbe.
+	probe bool
+
+	// mu is held while scraping, so concurrent requests share one scrape.
+	mu        sync.Mutex
+	registry  *metrics.Registry
+	timestamp time.Time
+	err       error
+	expires   time.Time
+}
+
+// NewScraper returns a Scraper that scrapes the zones returned by zones,
+// reusing the result for ttl and giving each scrape at most timeout to
+// complete.
+func NewScraper(c *Collector, zones func() []Zone, ttl, timeout time.Duration) *Scraper {
+	return &Scraper{
+		collector: c,
+		zones:     zones,
+		ttl:       ttl,
+		timeout:   timeout,
+	}
+}
+
+// NewProbe returns a Scraper that probes a single zone, which does not need to
+// be exported. Unlike a Scraper returned by NewScraper, the exporter series of
+// the zone are written along with its other series and errors never cause the
+// zone to be skipped.
+func NewProbe(c *Collector, zone Zone, ttl, timeout time.Duration) *Scraper {
+	zones := []Zone{zone}
+	return &Scraper{
+		collector: c,
+		zones:     func() []Zone { return zones },
+		ttl:       ttl,
+		timeout:   timeout,
+		probe:     true,
+	}
+}
+
+// WritePrometheus writes the series of the most recent complete minute, with
+// each sample timestamped at the start of the minute. The zones are only
+// scraped again once the cached result has expired.
+//
+// An error is returned if any query of the scrape failed, the series of every
+// query that succeeded are still written. The error is cached along with the
+// series.
+func (s *Scraper) WritePrometheus(ctx context.Context, w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.registry == nil || s.expired() {
+		if s.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.timeout)
+			defer cancel()
+		}
+		s.registry, s.timestamp, s.err = s.collector.scrape(ctx, s.zones(), s.probe)
+		s.expires = time.Now().Add(s.ttl)
+	}
+
+	if err := s.registry.WritePrometheus(w, s.timestamp); err != nil {
+		return err
+	}
+	return s.err
+}
+
+// expired reports whether the cached result has expired.
+func (s *Scraper) expired() bool {
+	return !time.Now().Before(s.expires)
+}
@@ -0,0 +1,488 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+// Package config ...
+package config
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+	"github.com/matthewpi/cloudflare-exporter/internal/metrics"
+)
+
+// Collection modes.
+const (
+	// ModeBackground collects on an interval and adds the results to
+	// counters.
+	ModeBackground = "background"
+
+	// ModeScrape collects whenever metrics are scraped and exposes the results
+	// of the most recent complete minute as timestamped gauges.
+	ModeScrape = "scrape"
+)
+
+// DefaultAccount is the name given to an account that does not specify one.
+const DefaultAccount = "default"
+
+// Config .
+type Config struct {
+	// Listen is the address the HTTP server listens on.
+	Listen string `yaml:"listen"`
+
+	// Mode is either ModeBackground or ModeScrape.
+	Mode string `yaml:"mode"`
+
+	// ScrapeCache is how long the result of a scrape is reused for in
+	// ModeScrape.
+	ScrapeCache time.Duration `yaml:"scrape_cache"`
+
+	// Interval is how often metrics are collected in ModeBackground.
+	Interval time.Duration `yaml:"interval"`
+
+	// Lag is how far behind the current time metrics are collected,
+	// Cloudflare takes a few minutes before analytics for a minute are
+	// complete.
+	Lag time.Duration `yaml:"lag"`
+
+	// CollectTimeout is the maximum duration of a single collection.
+	CollectTimeout time.Duration `yaml:"collect_timeout"`
+
+	// Lookback is the maximum age of a missed window that will be backfilled.
+	Lookback time.Duration `yaml:"lookback"`
+
+	// Limit is the maximum number of rows requested per zone and dataset.
+	Limit int `yaml:"limit"`
+
+	// BatchSize is the maximum number of zones sent in a single query.
+	BatchSize int `yaml:"batch_size"`
+
+	// Concurrency is the maximum number of queries running at once.
+	Concurrency int `yaml:"concurrency"`
+
+	// APIURL is the base URL of the Cloudflare API.
+	APIURL string `yaml:"api_url"`
+
+	// Timeout is the timeout of a single attempt of a request to Cloudflare.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Retries is the maximum number of times a request that failed with a
+	// transient error is retried.
+	Retries int `yaml:"retries"`
+
+	// RateLimit is the maximum number of requests per second sent for each
+	// account, and RateBurst the number of requests that may be sent at once.
+	RateLimit float64 `yaml:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst"`
+
+	// Record is the directory every API response is recorded to as a fixture,
+	// and Replay the directory fixtures are served from instead of the API.
+	Record string `yaml:"record"`
+	Replay string `yaml:"replay"`
+
+	// SeriesTTL is how long a series that is no longer updated is exported
+	// for, such as a country that stopped appearing in the data. If zero
+	// series are exported forever.
+	SeriesTTL time.Duration `yaml:"series_ttl"`
+
+	// StateFile is the path counters are persisted to across restarts.
+	StateFile string `yaml:"state_file"`
+
+	// StateInterval is how often the state file is written.
+	StateInterval time.Duration `yaml:"state_interval"`
+
+	// Datasets collected for zones that do not specify their own.
+	Datasets []cloudflare.Dataset `yaml:"datasets"`
+
+	// Accounts .
+	Accounts []*Account `yaml:"accounts"`
+
+	// Modules used by the /probe endpoint, keyed by name.
+	Modules map[string]*Module `yaml:"modules"`
+}
+
+// Module describes how a zone is probed.
+type Module struct {
+	// Account is the name of the account whose credentials are used.
+	Account string `yaml:"account"`
+
+	// Datasets collected for the zone, defaults to Config.Datasets.
+	Datasets []cloudflare.Dataset `yaml:"datasets"`
+}
+
+// Account .
+type Account struct {
+	// Name .
+	Name string `yaml:"name"`
+
+	// Token is an API token, used instead of Email and Key.
+	Token string `yaml:"token"`
+
+	// TokenFrom reads the API token from a secret instead of Token.
+	TokenFrom *Secret `yaml:"token_from"`
+
+	// Email and Key of a Global API Key.
+	Email string `yaml:"email"`
+	Key   string `yaml:"key"`
+
+	// KeyFrom reads the Global API Key from a secret instead of Key.
+	KeyFrom *Secret `yaml:"key_from"`
+
+	// Discover enables automatic discovery of the account's zones.
+	Discover *Discover `yaml:"discover"`
+
+	// Zones .
+	Zones []*Zone `yaml:"zones"`
+}
+
+// Secret is read from exactly one of a file, an environment variable or the
+// output of a command.
+type Secret struct {
+	// File is read again whenever it changes.
+	File string `yaml:"file"`
+
+	// Env is the name of an environment variable.
+	Env string `yaml:"env"`
+
+	// Command is run again every Refresh.
+	Command []string      `yaml:"command"`
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+// Source returns the secret source.
+func (s *Secret) Source() (cloudflare.Secret, error) {
+	switch {
+	case s.File != "":
+		return cloudflare.NewFileSecret(s.File), nil
+	case s.Env != "":
+		return cloudflare.EnvSecret(s.Env), nil
+	}
+	return cloudflare.NewExecSecret(s.Command, s.Refresh)
+}
+
+// HasToken reports whether the account uses an API token.
+func (a *Account) HasToken() bool {
+	return a.Token != "" || a.TokenFrom != nil
+}
+
+// HasKey reports whether the account has a Global API Key.
+func (a *Account) HasKey() bool {
+	return a.Key != "" || a.KeyFrom != nil
+}
+
+// Discover .
+type Discover struct {
+	// Include and Exclude are glob patterns matched against the zone name.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+
+	// Accounts is a list of Cloudflare account IDs to include.
+	Accounts []string `yaml:"accounts"`
+
+	// Plans is a list of plans to include.
+	Plans []string `yaml:"plans"`
+
+	// Interval is how often discovered zones are refreshed.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Filter .
+func (d *Discover) Filter() cloudflare.ZoneFilter {
+	return cloudflare.ZoneFilter{
+		Include:  d.Include,
+		Exclude:  d.Exclude,
+		Accounts: d.Accounts,
+		Plans:    d.Plans,
+	}
+}
+
+// Zone .
+type Zone struct {
+	// ID .
+	ID string `yaml:"id"`
+
+	// Name is the display name used in the zone label, defaults to the ID.
+	Name string `yaml:"name"`
+
+	// Labels are additional static labels added to every series of the zone.
+	Labels map[string]string `yaml:"labels"`
+
+	// Datasets collected for the zone, defaults to Config.Datasets.
+	Datasets []cloudflare.Dataset `yaml:"datasets"`
+}
+
+// Default returns a Config with every option set to its default.
+func Default() *Config {
+	return &Config{
+		Listen:         ":8089",
+		Mode:           ModeBackground,
+		ScrapeCache:    30 * time.Second,
+		Interval:       time.Minute,
+		Lag:            3 * time.Minute,
+		CollectTimeout: 5 * time.Minute,
+		Lookback:       time.Hour,
+		Limit:          1000,
+		BatchSize:      10,
+		Concurrency:    4,
+		APIURL:         cloudflare.DefaultURL,
+		Timeout:        30 * time.Second,
+		Retries:        3,
+		RateLimit:      4,
+		RateBurst:      10,
+		StateInterval:  time.Minute,
+		Datasets:       cloudflare.Datasets,
+	}
+}
+
+// Load reads the configuration file at path, options missing from the file
+// are set to their defaults.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "config: failed to read config")
+	}
+
+	c := Default()
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return nil, errors.Wrapf(err, "config: failed to parse %s", path)
+	}
+	return c, nil
+}
+
+// Validate returns an error describing every invalid option, each prefixed by
+// the key of the option.
+func (c *Config) Validate() error {
+	var errs []string
+	fail := func(key, format string, args ...interface{}) {
+		errs = append(errs, key+": "+errors.Errorf(format, args...).Error())
+	}
+
+	if c.Listen == "" {
+		fail("listen", "must not be empty")
+	}
+	switch c.Mode {
+	case ModeBackground:
+	case ModeScrape:
+		if c.StateFile != "" {
+			fail("state_file", "is not supported in %s mode", ModeScrape)
+		}
+	default:
+		fail("mode", "must be either %s or %s", ModeBackground, ModeScrape)
+	}
+	if c.ScrapeCache < 0 {
+		fail("scrape_cache", "must not be negative")
+	}
+	if c.Interval <= 0 {
+		fail("interval", "must be greater than 0")
+	}
+	if c.Lag < 0 {
+		fail("lag", "must not be negative")
+	}
+	if c.CollectTimeout <= 0 {
+		fail("collect_timeout", "must be greater than 0")
+	}
+	if c.Lookback < 0 {
+		fail("lookback", "must not be negative")
+	}
+	if c.Limit < 1 || c.Limit > 10000 {
+		fail("limit", "must be between 1 and 10000")
+	}
+	if c.BatchSize < 1 {
+		fail("batch_size", "must be at least 1")
+	}
+	if c.Concurrency < 1 {
+		fail("concurrency", "must be at least 1")
+	}
+	if u, err := url.Parse(c.APIURL); err != nil || u.Scheme == "" || u.Host == "" {
+		fail("api_url", "must be an absolute URL")
+	}
+	if c.Timeout < 0 {
+		fail("timeout", "must not be negative")
+	}
+	if c.Retries < 0 {
+		fail("retries", "must not be negative")
+	}
+	if c.RateLimit < 0 {
+		fail("rate_limit", "must not be negative")
+	}
+	if c.RateBurst < 1 {
+		fail("rate_burst", "must be at least 1")
+	}
+	if c.Record != "" && c.Replay != "" {
+		fail("record", "cannot be used with replay")
+	}
+	if c.SeriesTTL < 0 {
+		fail("series_ttl", "must not be negative")
+	}
+	if c.StateFile != "" && c.StateInterval <= 0 {
+		fail("state_interval", "must be greater than 0")
+	}
+	validateDatasets("datasets", c.Datasets, fail)
+
+	if len(c.Accounts) == 0 {
+		fail("accounts", "at least one account must be configured")
+	}
+	if len(c.Accounts) == 1 && c.Accounts[0].Name == "" {
+		c.Accounts[0].Name = DefaultAccount
+	}
+
+	accounts := map[string]struct{}{}
+	zones := map[string]string{}
+	for i, a := range c.Accounts {
+		key := "accounts[" + strconv.Itoa(i) + "]"
+		if a.Name == "" {
+			fail(key+".name", "must not be empty when multiple accounts are configured")
+		} else if _, ok := accounts[a.Name]; ok {
+			fail(key+".name", "duplicate account \"%s\"", a.Name)
+		}
+		accounts[a.Name] = struct{}{}
+
+		switch {
+		case a.Token != "" && a.TokenFrom != nil:
+			fail(key+".token_from", "must not be set together with token")
+		case a.Key != "" && a.KeyFrom != nil:
+			fail(key+".key_from", "must not be set together with key")
+		case a.HasToken() && (a.Email != "" || a.HasKey()):
+			fail(key+".token", "must not be set together with email and key")
+		case !a.HasToken() && (a.Email == "" || !a.HasKey()):
+			fail(key, "either token or email and key must be set")
+		}
+		validateSecret(key+".token_from", a.TokenFrom, fail)
+		validateSecret(key+".key_from", a.KeyFrom, fail)
+
+		if a.Discover == nil && len(a.Zones) == 0 {
+			fail(key, "either zones or discover must be set")
+		}
+		if d := a.Discover; d != nil {
+			if d.Interval == 0 {
+				d.Interval = 10 * time.Minute
+			}
+			if d.Interval < 0 {
+				fail(key+".discover.interval", "must be greater than 0")
+			}
+			if err := d.Filter().Validate(); err != nil {
+				fail(key+".discover", "%s", strings.TrimPrefix(err.Error(), "cloudflare: "))
+			}
+		}
+
+		for j, z := range a.Zones {
+			key := key + ".zones[" + strconv.Itoa(j) + "]"
+			if z.ID == "" {
+				fail(key+".id", "must not be empty")
+			} else if other, ok := zones[z.ID]; ok {
+				fail(key+".id", "zone \"%s\" is already configured by %s", z.ID, other)
+			} else {
+				zones[z.ID] = key
+			}
+			if z.Name == "" {
+				z.Name = z.ID
+			}
+			keys := make([]string, 0, len(z.Labels))
+			for k := range z.Labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if !metrics.ValidLabelName(k) || strings.HasPrefix(k, "__") {
+					fail(key+".labels."+k, "invalid label name")
+				} else if metrics.ReservedLabel(k) {
+					fail(key+".labels."+k, "label name is reserved")
+				}
+			}
+			validateDatasets(key+".datasets", z.Datasets, fail)
+		}
+	}
+
+	names := make([]string, 0, len(c.Modules))
+	for name := range c.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m, key := c.Modules[name], "modules."+name
+		if m == nil {
+			fail(key, "must not be empty")
+			continue
+		}
+		if m.Account == "" && len(c.Accounts) == 1 {
+			m.Account = c.Accounts[0].Name
+		}
+		if _, ok := accounts[m.Account]; !ok {
+			fail(key+".account", "unknown account \"%s\"", m.Account)
+		}
+		validateDatasets(key+".datasets", m.Datasets, fail)
+	}
+
+	if len(errs) > 0 {
+		return errors.New("config: " + strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+func validateSecret(
+	key string,
+	s *Secret,
+	fail func(key, format string, args ...interface{}),
+) {
+	if s == nil {
+		return
+	}
+
+	var n int
+	for _, set := range []bool{s.File != "", s.Env != "", len(s.Command) > 0} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		fail(key, "exactly one of file, env or command must be set")
+	}
+	if s.Refresh == 0 {
+		s.Refresh = 5 * time.Minute
+	}
+	if s.Refresh < 0 {
+		fail(key+".refresh", "must be greater than 0")
+	}
+}
+
+func validateDatasets(
+	key string,
+	datasets []cloudflare.Dataset,
+	fail func(key, format string, args ...interface{}),
+) {
+	for i, d := range datasets {
+		if !d.Valid() {
+			fail(key+"["+strconv.Itoa(i)+"]", "unknown dataset \"%s\"", d)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// updatedMu guards updated and is held while series are unregistered, so
+	// Counters never reads a series that is unregistered at the same time.
+	updatedMu sync.Mutex
+
+	// updated is the last time each global series of zone data was updated,
+	// keyed by its name.
+	updated = map[string]time.Time{}
+)
+
+// touch records that the series was updated. Only series of zone data are
+// tracked, the exporter's own series, such as the last successful collection
+// of a zone, must be exported for as long as the zone is.
+func touch(name string) {
+	if !strings.HasPrefix(name, "cloudflare_zone_") {
+		return
+	}
+	updatedMu.Lock()
+	updated[name] = time.Now()
+	updatedMu.Unlock()
+}
+
+// Expire unregisters every series that has not been updated within ttl, such
+// as a country or colocation that stopped appearing in the data, and returns
+// how many were unregistered.
+//
+// Series are updated whenever they are looked up, so a series that reappears
+// after expiring starts again from zero. The exporter's own series are never
+// expired.
+func Expire(ttl time.Duration) int {
+	cutoff := time.Now().Add(-ttl)
+
+	updatedMu.Lock()
+	defer updatedMu.Unlock()
+
+	var n int
+	for name, t := range updated {
+		if t.After(cutoff) {
+			continue
+		}
+		delete(updated, name)
+		if counters.UnregisterMetric(name) || set.UnregisterMetric(name) {
+			n++
+		}
+	}
+	return n
+}
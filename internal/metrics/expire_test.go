@@ -0,0 +1,84 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	zone := NewZone("expire", "example.com", nil)
+	ZoneRequestsCountry(zone, "US").Inc()
+	ZoneRequestsCountry(zone, "DE").Inc()
+
+	// Pretend DE stopped appearing in the data an hour ago.
+	name := newSeries("cloudflare_zone_requests_country").
+		zone(zone).
+		label("country", "DE").
+		String()
+	updatedMu.Lock()
+	updated[name] = time.Now().Add(-time.Hour)
+	updatedMu.Unlock()
+
+	if n := Expire(30 * time.Minute); n != 1 {
+		t.Fatalf("expected 1 series to expire, got %d", n)
+	}
+
+	var b bytes.Buffer
+	WritePrometheus(&b, false)
+	if !strings.Contains(b.String(), `zone="example.com",country="US"`) {
+		t.Error("expected the updated series to be kept")
+	}
+	if strings.Contains(b.String(), `zone="example.com",country="DE"`) {
+		t.Error("expected the stale series to be unregistered")
+	}
+}
+
+func TestExpireKeepsExporterSeries(t *testing.T) {
+	zone := NewZone("expire", "last-success.example", nil)
+	Unregister(zone)
+	ZoneRequestsTotal(zone).Inc()
+	ExporterLastSuccess(zone).Set(1)
+
+	// Pretend nothing was updated for an hour, as happens when every
+	// collection of the zone fails.
+	updatedMu.Lock()
+	for name := range updated {
+		updated[name] = time.Now().Add(-time.Hour)
+	}
+	updatedMu.Unlock()
+
+	Expire(30 * time.Minute)
+
+	var b bytes.Buffer
+	WritePrometheus(&b, false)
+	if !strings.Contains(b.String(), `cloudflare_exporter_last_success_timestamp_seconds{account="expire",zone="last-success.example"} 1`) {
+		t.Error("expected the last success of the zone to be kept")
+	}
+	if strings.Contains(b.String(), `cloudflare_zone_requests_total{account="expire",zone="last-success.example"}`) {
+		t.Error("expected the stale zone series to be unregistered")
+	}
+}
@@ -0,0 +1,155 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package metrics
+
+import (
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// ExporterCollectionsSkipped counts the times a dataset of the zone was not
+// collected because a previous collection of it was still running.
+func ExporterCollectionsSkipped(zone Zone, dataset string) *metrics.Counter {
+	return zone.set().GetOrCreateCounter(
+		newSeries("cloudflare_exporter_collections_skipped_total").
+			zone(zone).
+			label("dataset", dataset).
+			String(),
+	)
+}
+
+// ExporterDuplicatesDropped counts the windows of the zone and dataset whose
+// rows were dropped because the window had already been applied.
+func ExporterDuplicatesDropped(zone Zone, dataset string) *metrics.Counter {
+	return zone.set().GetOrCreateCounter(
+		newSeries("cloudflare_exporter_duplicates_dropped_total").
+			zone(zone).
+			label("dataset", dataset).
+			String(),
+	)
+}
+
+// ExporterFetchDuration .
+func ExporterFetchDuration(account, dataset string) *metrics.Histogram {
+	return set.GetOrCreateHistogram(
+		newSeries("cloudflare_exporter_fetch_duration_seconds").
+			label("account", account).
+			label("dataset", dataset).
+			String(),
+	)
+}
+
+// ExporterFetchSuccesses .
+func ExporterFetchSuccesses(account, dataset string) *metrics.Counter {
+	return set.GetOrCreateCounter(
+		newSeries("cloudflare_exporter_fetch_successes_total").
+			label("account", account).
+			label("dataset", dataset).
+			String(),
+	)
+}
+
+// ExporterFetchFailures .
+func ExporterFetchFailures(account, dataset, class string) *metrics.Counter {
+	return set.GetOrCreateCounter(
+		newSeries("cloudflare_exporter_fetch_failures_total").
+			label("account", account).
+			label("dataset", dataset).
+			label("class", class).
+			String(),
+	)
+}
+
+// ExporterLastSuccess is set to the unix timestamp of the last successful
+// fetch of the zone.
+func ExporterLastSuccess(zone Zone) *metrics.FloatCounter {
+	return zone.set().GetOrCreateFloatCounter(
+		newSeries("cloudflare_exporter_last_success_timestamp_seconds").
+			zone(zone).
+			String(),
+	)
+}
+
+// ExporterResponseSize .
+func ExporterResponseSize(account string) *metrics.Histogram {
+	return set.GetOrCreateHistogram(
+		newSeries("cloudflare_exporter_response_size_bytes").
+			label("account", account).
+			String(),
+	)
+}
+
+// ExporterRunsSkipped counts the scheduled collections that did not start
+// because the previous collection was still running.
+func ExporterRunsSkipped() *metrics.Counter {
+	return set.GetOrCreateCounter("cloudflare_exporter_runs_skipped_total")
+}
+
+// ExporterRowsReturned is set to the number of rows returned for the zone and
+// dataset by the last fetch.
+func ExporterRowsReturned(zone Zone, dataset string) *metrics.FloatCounter {
+	return zone.set().GetOrCreateFloatCounter(
+		newSeries("cloudflare_exporter_rows_returned").
+			zone(zone).
+			label("dataset", dataset).
+			String(),
+	)
+}
+
+// ExporterRowsLimit is set to the maximum number of rows requested per zone
+// and dataset.
+func ExporterRowsLimit() *metrics.FloatCounter {
+	return set.GetOrCreateFloatCounter("cloudflare_exporter_rows_limit")
+}
+
+// ExporterSeriesExpired counts the series unregistered because they were not
+// updated within the series TTL.
+func ExporterSeriesExpired() *metrics.Counter {
+	return set.GetOrCreateCounter("cloudflare_exporter_series_expired_total")
+}
+
+// ExporterTruncated .
+func ExporterTruncated(zone Zone, dataset string) *metrics.Counter {
+	return zone.set().GetOrCreateCounter(
+		newSeries("cloudflare_exporter_truncated_total").
+			zone(zone).
+			label("dataset", dataset).
+			String(),
+	)
+}
+
+// ExporterZoneErrors counts the errors that prevented a dataset from being
+// collected for the zone, by kind of error.
+func ExporterZoneErrors(zone Zone, dataset, kind string) *metrics.Counter {
+	return zone.set().GetOrCreateCounter(
+		newSeries("cloudflare_exporter_zone_errors_total").
+			zone(zone).
+			label("dataset", dataset).
+			label("kind", kind).
+			String(),
+	)
+}
+
+// ExporterZones is set to the number of exported zones.
+func ExporterZones() *metrics.FloatCounter {
+	return set.GetOrCreateFloatCounter("cloudflare_exporter_zones")
+}
@@ -42,157 +42,422 @@ import (
 //
 func WritePrometheus(w io.Writer, exposeProcessMetrics bool) {
 	metrics.WritePrometheus(w, exposeProcessMetrics)
+	counters.WritePrometheus(w)
+	set.WritePrometheus(w)
+}
+
+var (
+	// counters holds every Cloudflare counter, these are kept separate so
+	// they can be persisted across restarts.
+	counters = metrics.NewSet()
+
+	// set holds every other Cloudflare metric.
+	set = metrics.NewSet()
+)
+
+// Counters returns the value of every Cloudflare counter.
+func Counters() map[string]uint64 {
+	// Hold the lock series are unregistered under, otherwise a series that
+	// is unregistered after listing the names would be created again by
+	// GetOrCreateCounter and never expire.
+	updatedMu.Lock()
+	defer updatedMu.Unlock()
+
+	names := counters.ListMetricNames()
+	m := make(map[string]uint64, len(names))
+	for _, name := range names {
+		m[name] = counters.GetOrCreateCounter(name).Get()
+	}
+	return m
+}
+
+// RestoreCounters sets the value of every counter in m, counters with an
+// invalid name are ignored.
+func RestoreCounters(m map[string]uint64) {
+	for name, v := range m {
+		restoreCounter(name, v)
+	}
+}
+
+func restoreCounter(name string, v uint64) {
+	// GetOrCreateCounter panics if the name is invalid, which may happen if
+	// the state was modified by hand.
+	defer func() {
+		_ = recover()
+	}()
+	counters.GetOrCreateCounter(name).Set(v)
+	touch(name)
 }
 
 // ZoneRequestsTotal .
-func ZoneRequestsTotal(zone string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_requests_total{" +
-			"zone=\"" + zone + "\"" +
-			"}",
+func ZoneRequestsTotal(zone Zone) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_requests_total").
+			zone(zone).
+			String(),
 	)
 }
 
 // ZoneRequestsCached .
-func ZoneRequestsCached(zone string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_requests_cached{" +
-			"zone=\"" + zone + "\"" +
-			"}",
+func ZoneRequestsCached(zone Zone) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_requests_cached").
+			zone(zone).
+			String(),
 	)
 }
 
 // ZoneRequestsEncrypted .
-func ZoneRequestsEncrypted(zone string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_requests_encrypted{" +
-			"zone=\"" + zone + "\"" +
-			"}",
+func ZoneRequestsEncrypted(zone Zone) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_requests_encrypted").
+			zone(zone).
+			String(),
 	)
 }
 
 // ZoneRequestsContentType .
-func ZoneRequestsContentType(zone, contentType string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_requests_content_type{" +
-			"zone=\"" + zone + "\"," +
-			"content_type=\"" + contentType + "\"" +
-			"}",
+func ZoneRequestsContentType(zone Zone, contentType string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_requests_content_type").
+			zone(zone).
+			label("content_type", contentType).
+			String(),
 	)
 }
 
 // ZoneRequestsCountry .
-func ZoneRequestsCountry(zone, country string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_requests_country{" +
-			"zone=\"" + zone + "\"," +
-			"country=\"" + country + "\"" +
-			"}",
+func ZoneRequestsCountry(zone Zone, country string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_requests_country").
+			zone(zone).
+			label("country", country).
+			String(),
 	)
 }
 
 // ZoneRequestsStatus .
-func ZoneRequestsStatus(zone, status string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_requests_status{" +
-			"zone=\"" + zone + "\"," +
-			"status=\"" + status + "\"" +
-			"}",
+func ZoneRequestsStatus(zone Zone, status string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_requests_status").
+			zone(zone).
+			label("status", status).
+			String(),
+	)
+}
+
+// ZoneRequestsHTTPVersion .
+func ZoneRequestsHTTPVersion(zone Zone, protocol string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_requests_http_version").
+			zone(zone).
+			label("protocol", protocol).
+			String(),
+	)
+}
+
+// ZoneRequestsTLSVersion .
+func ZoneRequestsTLSVersion(zone Zone, version string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_requests_tls_version").
+			zone(zone).
+			label("version", version).
+			String(),
+	)
+}
+
+// ZoneRequestsIPClass .
+func ZoneRequestsIPClass(zone Zone, ipClass string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_requests_ip_class").
+			zone(zone).
+			label("ip_class", ipClass).
+			String(),
+	)
+}
+
+// ZonePageViewsTotal .
+func ZonePageViewsTotal(zone Zone) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_pageviews_total").
+			zone(zone).
+			String(),
+	)
+}
+
+// ZonePageViewsBrowser .
+func ZonePageViewsBrowser(zone Zone, browser string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_pageviews_browser").
+			zone(zone).
+			label("browser", browser).
+			String(),
+	)
+}
+
+// ZoneUniques is set to the number of unique visitors in the most recent
+// minute.
+func ZoneUniques(zone Zone) *metrics.FloatCounter {
+	return zone.set().GetOrCreateFloatCounter(
+		newSeries("cloudflare_zone_uniques").
+			zone(zone).
+			String(),
 	)
 }
 
 // ZoneBandwidthTotal .
-func ZoneBandwidthTotal(zone string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_bandwidth_total{" +
-			"zone=\"" + zone + "\"" +
-			"}",
+func ZoneBandwidthTotal(zone Zone) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_bandwidth_total").
+			zone(zone).
+			String(),
 	)
 }
 
 // ZoneBandwidthCached .
-func ZoneBandwidthCached(zone string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_bandwidth_cached{" +
-			"zone=\"" + zone + "\"" +
-			"}",
+func ZoneBandwidthCached(zone Zone) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_bandwidth_cached").
+			zone(zone).
+			String(),
 	)
 }
 
 // ZoneBandwidthEncrypted .
-func ZoneBandwidthEncrypted(zone string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_bandwidth_encrypted{" +
-			"zone=\"" + zone + "\"" +
-			"}",
+func ZoneBandwidthEncrypted(zone Zone) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_bandwidth_encrypted").
+			zone(zone).
+			String(),
 	)
 }
 
 // ZoneBandwidthContentType .
-func ZoneBandwidthContentType(zone, contentType string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_bandwidth_content_type{" +
-			"zone=\"" + zone + "\"," +
-			"content_type=\"" + contentType + "\"" +
-			"}",
+func ZoneBandwidthContentType(zone Zone, contentType string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_bandwidth_content_type").
+			zone(zone).
+			label("content_type", contentType).
+			String(),
 	)
 }
 
 // ZoneBandwidthCountry .
-func ZoneBandwidthCountry(zone, country string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_bandwidth_country{" +
-			"zone=\"" + zone + "\"," +
-			"country=\"" + country + "\"" +
-			"}",
+func ZoneBandwidthCountry(zone Zone, country string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_bandwidth_country").
+			zone(zone).
+			label("country", country).
+			String(),
 	)
 }
 
 // ZoneColocationVisits .
-func ZoneColocationVisits(zone, colocation string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_colocation_visits{" +
-			"zone=\"" + zone + "\"," +
-			"colocation=\"" + colocation + "\"" +
-			"}",
+func ZoneColocationVisits(zone Zone, colocation string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_colocation_visits").
+			zone(zone).
+			label("colocation", colocation).
+			String(),
 	)
 }
 
 // ZoneColocationResponseBytes .
-func ZoneColocationResponseBytes(zone, colocation string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_colocation_response_bytes{" +
-			"zone=\"" + zone + "\"," +
-			"colocation=\"" + colocation + "\"" +
-			"}",
+func ZoneColocationResponseBytes(zone Zone, colocation string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_colocation_response_bytes").
+			zone(zone).
+			label("colocation", colocation).
+			String(),
 	)
 }
 
 // ZoneThreatsTotal .
-func ZoneThreatsTotal(zone string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_threats_total{" +
-			"zone=\"" + zone + "\"" +
-			"}",
+func ZoneThreatsTotal(zone Zone) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_threats_total").
+			zone(zone).
+			String(),
 	)
 }
 
 // ZoneThreatsCountry .
-func ZoneThreatsCountry(zone, country string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_threats_country{" +
-			"zone=\"" + zone + "\"," +
-			"country=\"" + country + "\"" +
-			"}",
+func ZoneThreatsCountry(zone Zone, country string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_threats_country").
+			zone(zone).
+			label("country", country).
+			String(),
 	)
 }
 
 // ZoneThreatsType .
-func ZoneThreatsType(zone, threatType string) *metrics.Counter {
-	return metrics.GetOrCreateCounter(
-		"cloudflare_zone_threats_type{" +
-			"zone=\"" + zone + "\"," +
-			"type=\"" + threatType + "\"" +
-			"}",
+func ZoneThreatsType(zone Zone, threatType string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_threats_type").
+			zone(zone).
+			label("type", threatType).
+			String(),
+	)
+}
+
+// ZoneFirewallEvents .
+func ZoneFirewallEvents(zone Zone, action, source, host, country string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_firewall_events").
+			zone(zone).
+			label("action", action).
+			label("source", source).
+			label("host", host).
+			label("country", country).
+			String(),
+	)
+}
+
+// ZoneHealthCheckRTT .
+func ZoneHealthCheckRTT(zone Zone, healthCheck, region string) *metrics.Histogram {
+	return zone.set().GetOrCreateHistogram(
+		newSeries("cloudflare_zone_health_check_rtt_ms").
+			zone(zone).
+			label("health_check", healthCheck).
+			label("region", region).
+			String(),
+	)
+}
+
+// ZoneHealthCheckTCPConn .
+func ZoneHealthCheckTCPConn(zone Zone, healthCheck, region string) *metrics.Histogram {
+	return zone.set().GetOrCreateHistogram(
+		newSeries("cloudflare_zone_health_check_tcp_conn_ms").
+			zone(zone).
+			label("health_check", healthCheck).
+			label("region", region).
+			String(),
+	)
+}
+
+// ZoneHealthCheckTLSHandshake .
+func ZoneHealthCheckTLSHandshake(zone Zone, healthCheck, region string) *metrics.Histogram {
+	return zone.set().GetOrCreateHistogram(
+		newSeries("cloudflare_zone_health_check_tls_handshake_ms").
+			zone(zone).
+			label("health_check", healthCheck).
+			label("region", region).
+			String(),
+	)
+}
+
+// ZoneHealthCheckTTFB .
+func ZoneHealthCheckTTFB(zone Zone, healthCheck, region string) *metrics.Histogram {
+	return zone.set().GetOrCreateHistogram(
+		newSeries("cloudflare_zone_health_check_ttfb_ms").
+			zone(zone).
+			label("health_check", healthCheck).
+			label("region", region).
+			String(),
+	)
+}
+
+// ZoneHealthCheckHealthy is set to 1 if the most recent event for the health
+// check was healthy, otherwise 0.
+func ZoneHealthCheckHealthy(zone Zone, healthCheck, region string) *metrics.FloatCounter {
+	return zone.set().GetOrCreateFloatCounter(
+		newSeries("cloudflare_zone_health_check_healthy").
+			zone(zone).
+			label("health_check", healthCheck).
+			label("region", region).
+			String(),
+	)
+}
+
+// ZoneHealthCheckChanges .
+func ZoneHealthCheckChanges(zone Zone, healthCheck, region, failureReason string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_health_check_changes").
+			zone(zone).
+			label("health_check", healthCheck).
+			label("region", region).
+			label("failure_reason", failureReason).
+			String(),
+	)
+}
+
+// ZoneLoadBalancerRequests .
+func ZoneLoadBalancerRequests(zone Zone, lb, pool, origin, colocation string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_load_balancer_requests").
+			zone(zone).
+			label("lb", lb).
+			label("pool", pool).
+			label("origin", origin).
+			label("colocation", colocation).
+			String(),
+	)
+}
+
+// ZoneLoadBalancerErrors counts the sampled load balancer requests that failed,
+// by error type. Requests without an error are not counted.
+func ZoneLoadBalancerErrors(zone Zone, lb, errorType string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_load_balancer_errors").
+			zone(zone).
+			label("lb", lb).
+			label("error_type", errorType).
+			String(),
+	)
+}
+
+// ZoneLoadBalancerSteeringPolicy .
+func ZoneLoadBalancerSteeringPolicy(zone Zone, lb, policy string) *metrics.Counter {
+	return zone.counters().GetOrCreateCounter(
+		newSeries("cloudflare_zone_load_balancer_steering_policy").
+			zone(zone).
+			label("lb", lb).
+			label("policy", policy).
+			String(),
+	)
+}
+
+// ZoneLoadBalancerPoolHealthy .
+func ZoneLoadBalancerPoolHealthy(zone Zone, lb, pool string) *metrics.FloatCounter {
+	return zone.set().GetOrCreateFloatCounter(
+		newSeries("cloudflare_zone_load_balancer_pool_healthy").
+			zone(zone).
+			label("lb", lb).
+			label("pool", pool).
+			String(),
+	)
+}
+
+// ZoneLoadBalancerPoolRTT .
+func ZoneLoadBalancerPoolRTT(zone Zone, lb, pool string) *metrics.FloatCounter {
+	return zone.set().GetOrCreateFloatCounter(
+		newSeries("cloudflare_zone_load_balancer_pool_rtt_ms").
+			zone(zone).
+			label("lb", lb).
+			label("pool", pool).
+			String(),
+	)
+}
+
+// ZoneLoadBalancerOriginHealthy .
+func ZoneLoadBalancerOriginHealthy(zone Zone, lb, origin string) *metrics.FloatCounter {
+	return zone.set().GetOrCreateFloatCounter(
+		newSeries("cloudflare_zone_load_balancer_origin_healthy").
+			zone(zone).
+			label("lb", lb).
+			label("origin", origin).
+			String(),
+	)
+}
+
+// ZoneLoadBalancerOriginWeight .
+func ZoneLoadBalancerOriginWeight(zone Zone, lb, origin string) *metrics.FloatCounter {
+	return zone.set().GetOrCreateFloatCounter(
+		newSeries("cloudflare_zone_load_balancer_origin_weight").
+			zone(zone).
+			label("lb", lb).
+			label("origin", origin).
+			String(),
 	)
 }
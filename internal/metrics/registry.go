@@ -0,0 +1,88 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Registry holds the series of a single scrape-time collection. Unlike the
+// global series, every sample is written with an explicit timestamp.
+type Registry struct {
+	set *metrics.Set
+}
+
+// NewRegistry .
+func NewRegistry() *Registry {
+	return &Registry{set: metrics.NewSet()}
+}
+
+// Zone returns zone with its series created in the registry.
+func (r *Registry) Zone(zone Zone) Zone {
+	zone.registry = r
+	return zone
+}
+
+// WritePrometheus writes every series in the registry in the Prometheus text
+// format, with each sample timestamped at t.
+func (r *Registry) WritePrometheus(w io.Writer, t time.Time) error {
+	var b bytes.Buffer
+	r.set.WritePrometheus(&b)
+
+	ts := " " + strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) + "\n"
+	bw := bufio.NewWriter(w)
+	sc := bufio.NewScanner(&b)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			_, _ = bw.WriteString(line + "\n")
+			continue
+		}
+		_, _ = bw.WriteString(line + ts)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// WriteProbe writes the outcome of a probe in the Prometheus text format.
+func WriteProbe(w io.Writer, success bool, duration time.Duration) {
+	s := metrics.NewSet()
+	var v float64
+	if success {
+		v = 1
+	}
+	s.GetOrCreateFloatCounter("cloudflare_probe_success").Set(v)
+	s.GetOrCreateFloatCounter("cloudflare_probe_duration_seconds").Set(duration.Seconds())
+	s.WritePrometheus(w)
+}
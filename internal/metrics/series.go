@@ -0,0 +1,119 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package metrics
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// metricName matches a valid Prometheus metric name.
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+	// labelName matches a valid Prometheus label name.
+	labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// labelValue escapes a label value as required by the Prometheus text
+	// format.
+	labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// series builds the name of a series, such as `name{label="value"}`, as
+// expected by the GetOrCreate methods of a set.
+//
+// Label values may contain anything, such as values returned by Cloudflare or
+// a zone name from the configuration, so they are always escaped. Invalid
+// metric and label names are a bug in the exporter and panic.
+type series struct {
+	b      strings.Builder
+	labels int
+
+	// scoped is set if the series belongs to a registry rather than the
+	// global sets, and so is not tracked for expiry.
+	scoped bool
+}
+
+// newSeries returns a series of the named metric.
+func newSeries(name string) *series {
+	if !metricName.MatchString(name) {
+		panic("metrics: invalid metric name " + strconv.Quote(name))
+	}
+	s := &series{}
+	s.b.WriteString(name)
+	return s
+}
+
+// zone adds the labels of the zone to the series.
+func (s *series) zone(zone Zone) *series {
+	s.add(zone.labels)
+	s.scoped = s.scoped || zone.registry != nil
+	return s
+}
+
+// label adds a label to the series.
+func (s *series) label(name, value string) *series {
+	s.add(renderLabel(name, value))
+	return s
+}
+
+// add adds an already rendered list of labels to the series.
+func (s *series) add(labels string) {
+	if labels == "" {
+		return
+	}
+	if s.labels == 0 {
+		s.b.WriteByte('{')
+	} else {
+		s.b.WriteByte(',')
+	}
+	s.b.WriteString(labels)
+	s.labels++
+}
+
+// String returns the name of the series and records that the series was
+// updated, see Expire.
+func (s *series) String() string {
+	name := s.b.String()
+	if s.labels > 0 {
+		name += "}"
+	}
+	if !s.scoped {
+		touch(name)
+	}
+	return name
+}
+
+// ValidLabelName reports whether name is a valid Prometheus label name.
+func ValidLabelName(name string) bool {
+	return labelName.MatchString(name)
+}
+
+// renderLabel returns the label as written in a series name.
+func renderLabel(name, value string) string {
+	if !ValidLabelName(name) {
+		panic("metrics: invalid label name " + strconv.Quote(name))
+	}
+	return name + `="` + labelValue.Replace(strings.ToValidUTF8(value, "\uFFFD")) + `"`
+}
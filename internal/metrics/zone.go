@@ -0,0 +1,192 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+package metrics
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Zone holds the labels identifying the zone a series belongs to.
+type Zone struct {
+	// labels is the pre-rendered list of labels for the zone.
+	labels string
+
+	// registry the zone's series are created in, if nil the global series
+	// are used.
+	registry *Registry
+}
+
+// NewZone returns a Zone belonging to the named account, with the given
+// display name and additional static labels. It panics if the name of a static
+// label is invalid, which the configuration does not allow.
+func NewZone(account, name string, labels map[string]string) Zone {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := renderLabel("account", account) + "," + renderLabel("zone", name)
+	for _, k := range keys {
+		s += "," + renderLabel(k, labels[k])
+	}
+	return Zone{labels: s}
+}
+
+// counters returns the set the zone's counters are created in.
+func (z Zone) counters() *metrics.Set {
+	if z.registry != nil {
+		return z.registry.set
+	}
+	return counters
+}
+
+// set returns the set the zone's other series are created in.
+func (z Zone) set() *metrics.Set {
+	if z.registry != nil {
+		return z.registry.set
+	}
+	return set
+}
+
+// reservedLabels are label names used by the exporter's series.
+var reservedLabels = map[string]struct{}{
+	"account":        {},
+	"action":         {},
+	"browser":        {},
+	"class":          {},
+	"colocation":     {},
+	"content_type":   {},
+	"country":        {},
+	"dataset":        {},
+	"error_type":     {},
+	"failure_reason": {},
+	"health_check":   {},
+	"host":           {},
+	"ip_class":       {},
+	"kind":           {},
+	"lb":             {},
+	"origin":         {},
+	"policy":         {},
+	"pool":           {},
+	"protocol":       {},
+	"region":         {},
+	"source":         {},
+	"status":         {},
+	"type":           {},
+	"version":        {},
+	"vmrange":        {},
+	"zone":           {},
+}
+
+// ReservedLabel reports whether name is used by any of the exporter's series
+// and therefore cannot be used as a static label.
+func ReservedLabel(name string) bool {
+	_, ok := reservedLabels[name]
+	return ok
+}
+
+// Unregister removes every series belonging to the zone.
+func Unregister(zone Zone) {
+	updatedMu.Lock()
+	defer updatedMu.Unlock()
+
+	for _, s := range []*metrics.Set{counters, set} {
+		for _, name := range s.ListMetricNames() {
+			if belongsTo(name, zone) {
+				s.UnregisterMetric(name)
+			}
+		}
+	}
+	for name := range updated {
+		if belongsTo(name, zone) {
+			delete(updated, name)
+		}
+	}
+}
+
+// UnregisterExcept removes every series belonging to a zone other than the
+// given zones.
+func UnregisterExcept(zones []Zone) {
+	updatedMu.Lock()
+	defer updatedMu.Unlock()
+
+	keep := func(name string) bool {
+		if !hasZone(name) {
+			return true
+		}
+		for _, z := range zones {
+			if belongsTo(name, z) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range []*metrics.Set{counters, set} {
+		for _, name := range s.ListMetricNames() {
+			if !keep(name) {
+				s.UnregisterMetric(name)
+			}
+		}
+	}
+	for name := range updated {
+		if !keep(name) {
+			delete(updated, name)
+		}
+	}
+}
+
+// hasZone reports whether the series name belongs to any zone. A quote inside
+// a label value is always escaped, so the zone label cannot be matched inside
+// the value of another label.
+func hasZone(name string) bool {
+	i := strings.IndexByte(name, '{')
+	return i >= 0 && strings.HasPrefix(name[i+1:], `account="`) && strings.Contains(name[i:], `",zone="`)
+}
+
+// belongsTo reports whether the series name belongs to the zone.
+//
+// As static labels can never use a reserved name, the zone's labels must be
+// followed by either the end of the labels or a reserved label, otherwise the
+// series belongs to a zone with additional static labels.
+func belongsTo(name string, zone Zone) bool {
+	i := strings.IndexByte(name, '{')
+	if i < 0 || !strings.HasPrefix(name[i+1:], zone.labels) {
+		return false
+	}
+	rest := name[i+1+len(zone.labels):]
+	if strings.HasPrefix(rest, "}") {
+		return true
+	}
+	if !strings.HasPrefix(rest, ",") {
+		return false
+	}
+	rest = rest[1:]
+	if j := strings.IndexByte(rest, '='); j >= 0 {
+		return ReservedLabel(rest[:j])
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+//
+// Copyright (c) 2021 Matthew Penner
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+
+// Package state ...
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewpi/cloudflare-exporter/internal/cloudflare"
+)
+
+// version is the current version of the state file format.
+//
+// Version 2 added the account label to every series, counters persisted by
+// version 1 are dropped as their names no longer match any series.
+const version = 2
+
+// State is persisted to disk so counters survive a restart.
+type State struct {
+	// Version .
+	Version int `json:"version"`
+
+	// Counters is the value of every counter, keyed by series name.
+	Counters map[string]uint64 `json:"counters"`
+
+	// Ingested is the end of the last window ingested for each zone and
+	// dataset.
+	Ingested map[string]map[cloudflare.Dataset]time.Time `json:"ingested"`
+
+	// Applied lists the windows whose rows have been applied to the counters
+	// for each zone and dataset.
+	Applied map[string]map[cloudflare.Dataset][]Span `json:"applied,omitempty"`
+}
+
+// Span is a window of time, Start is inclusive and End exclusive.
+type Span struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Load reads the state from path. An empty State is returned if the file does
+// not exist.
+func Load(path string) (*State, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &State{Version: version}, nil
+		}
+		return nil, errors.Wrap(err, "state: failed to read state")
+	}
+
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, errors.Wrap(err, "state: failed to decode state")
+	}
+	switch s.Version {
+	case 1:
+		s.Version, s.Counters = version, nil
+	case version:
+	default:
+		return nil, errors.Errorf("state: unsupported version %d", s.Version)
+	}
+	return &s, nil
+}
+
+// Save atomically writes the state to path.
+//
+// The state is written to a temporary file in the same directory, synced and
+// then renamed over path so a crash never leaves a partially written file.
+func Save(path string, s *State) error {
+	s.Version = version
+	b, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "state: failed to encode state")
+	}
+
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "state: failed to create temporary file")
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "state: failed to write state")
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "state: failed to sync state")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "state: failed to close state")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrap(err, "state: failed to rename state")
+	}
+
+	// Sync the directory so the rename is durable.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+	return nil
+}